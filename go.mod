@@ -3,6 +3,10 @@ module github.com/jnsoft/xfer
 go 1.25.1
 
 require (
-	golang.org/x/crypto v0.42.0 // indirect
-	golang.org/x/sys v0.36.0 // indirect
+	github.com/creack/pty v1.1.24
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.42.0
+	golang.org/x/term v0.35.0
 )
+
+require golang.org/x/sys v0.36.0 // indirect
@@ -3,79 +3,203 @@ package client
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"os"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/socks"
 )
 
-func RunClient(target string, timeout int, secure, use_tls bool, secret, certFile string) {
-	conn, err := net.Dial("tcp", target)
+// RunClient connects to target, wraps the connection according to opts and
+// runs handler on it.
+func RunClient(target string, opts connection.Options, handler connection.Handler) {
+	conn, err := Dial(target, opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "connect error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(2)
 	}
 	defer conn.Close()
 
-	var useConn net.Conn = conn
-	if use_tls {
+	connection.ApplyTimeout(conn, opts.Timeout)
+	if err := handler(conn); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		_ = conn.Close()
+		os.Exit(connection.ExitCode(err))
+	}
+}
+
+// Dial connects to target, directly, through opts.Proxy or over the stdio of
+// opts.ProxyCmd, performs the client side of the TLS or AE handshake
+// selected in opts and adds the optional stream layers. A failed attempt
+// is repeated opts.Retry times, or forever if it is negative, with
+// backoff; see retriable for what is not.
+func Dial(target string, opts connection.Options) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := dialOnce(target, opts)
+		if err == nil || !retriable(err) || opts.Retry >= 0 && attempt > opts.Retry {
+			return conn, err
+		}
+		wait := backoff(attempt)
+		fmt.Fprintf(os.Stderr, "%v; retrying in %v\n", err, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+	}
+}
+
+// backoff is the pause before attempt+1: exponential from 250ms, capped at
+// 30s, with a random half taken off so clients started together spread out.
+func backoff(attempt int) time.Duration {
+	d := 30 * time.Second
+	if attempt < 8 {
+		d = min(d, 250*time.Millisecond<<(attempt-1))
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// permanentError marks a failure that another attempt cannot fix.
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// retriable reports whether Dial should try again after err. Setup
+// mistakes and rejected credentials are final: a wrong key stays wrong, and
+// hammering the server with it helps nobody.
+func retriable(err error) bool {
+	var pe permanentError
+	return !errors.As(err, &pe) &&
+		!errors.Is(err, connection.ErrAuthFailed) &&
+		!errors.Is(err, socks.ErrAuthFailed)
+}
+
+func dialOnce(target string, opts connection.Options) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case opts.ProxyCmd != "":
+		conn, err = dialCommand(opts.ProxyCmd, target)
+	case opts.Proxy != "":
+		conn, err = dialProxy(target, opts)
+	case opts.UDP:
+		conn, err = dialIP("udp", target, opts)
+	default:
+		conn, err = dialIP("tcp", target, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect error: %w", err)
+	}
+
+	useConn, err := connection.Handshake(conn, opts.HandshakeTimeout, func() (net.Conn, error) {
+		c, err := wrapConn(conn, opts)
+		if err == nil && !opts.UDP {
+			c, err = connection.WrapStream(c, opts)
+		}
+		return c, err
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return useConn, nil
+}
+
+// dialIP dials target over network ("tcp" or "udp") narrowed to
+// opts.Family, from opts.Source if set and within opts.ConnectTimeout. A
+// Unix socket target is dialed as such, see connection.SplitNetwork.
+func dialIP(network, target string, opts connection.Options) (net.Conn, error) {
+	d := net.Dialer{Timeout: time.Duration(opts.ConnectTimeout) * time.Second}
+	conn, err := dialWith(&d, network, target, opts)
+	if err != nil && d.Timeout > 0 && connection.IsTimeout(err) {
+		return nil, fmt.Errorf("%w: no answer from %s in %v", connection.ErrConnectTimeout, target, d.Timeout)
+	}
+	return conn, err
+}
+
+// dialWith does dialIP's work with d, binding it to opts.Source first.
+func dialWith(d *net.Dialer, network, target string, opts connection.Options) (net.Conn, error) {
+	if connection.IsUnixAddr(target) {
+		network, address := connection.SplitNetwork(target)
+		return d.Dial(network, address)
+	}
+	network = connection.Network(network, opts.Family)
+	if opts.Source != "" {
+		src := opts.Source
+		if _, _, err := net.SplitHostPort(src); err != nil {
+			src = net.JoinHostPort(src, "0")
+		}
+		var err error
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr, err = net.ResolveUDPAddr(network, src)
+		} else {
+			d.LocalAddr, err = net.ResolveTCPAddr(network, src)
+		}
+		if err != nil {
+			return nil, permanentError{fmt.Errorf("invalid source address %q: %w", opts.Source, err)}
+		}
+	}
+	return d.Dial(network, target)
+}
+
+// wrapConn runs the handshake over any byte stream; one that is not a
+// net.Conn gets emulated deadlines.
+func wrapConn(rwc io.ReadWriteCloser, opts connection.Options) (net.Conn, error) {
+	conn := connection.RWConn(rwc, "pipe")
+	if opts.UDP {
+		if !opts.Secure {
+			return conn, nil
+		}
+		timeout := time.Duration(opts.HandshakeTimeout) * time.Second
+		secureConn, err := connection.WrapDatagramWithAE(conn, false, opts.Secret, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("handshake error: %w", err)
+		}
+		return secureConn, nil
+	}
+
+	if opts.TLS {
 		tlsConf := &tls.Config{
 			MinVersion:         tls.VersionTLS13,
 			InsecureSkipVerify: true, // WARNING: for demo only!
 		}
-		if certFile != "" {
-			caCert, err := os.ReadFile(certFile)
+		if opts.CertFile != "" {
+			caCert, err := os.ReadFile(opts.CertFile)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to read cert file: %v\n", err)
-				os.Exit(2)
+				return nil, permanentError{fmt.Errorf("failed to read cert file: %w", err)}
 			}
 			caPool := x509.NewCertPool()
 			if !caPool.AppendCertsFromPEM(caCert) {
-				fmt.Fprintf(os.Stderr, "Failed to parse cert file\n")
-				os.Exit(2)
+				return nil, permanentError{errors.New("failed to parse cert file")}
 			}
 			tlsConf.RootCAs = caPool
 		}
 		tlsConn := tls.Client(conn, tlsConf)
 		if err := tlsConn.Handshake(); err != nil {
-			fmt.Fprintf(os.Stderr, "TLS handshake error: %v\n", err)
-			os.Exit(2)
-		}
-		useConn = tlsConn
-		defer tlsConn.Close()
-	} else if secure {
-		secureConn, err := connection.WrapWithAE(conn, false, secret)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "handshake error: %v\n", err)
-			os.Exit(2)
+			return nil, fmt.Errorf("TLS handshake error: %w", err)
 		}
-		useConn = secureConn
-		defer secureConn.Close()
+		return tlsConn, nil
 	}
 
-	connection.ApplyTimeout(useConn, timeout)
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// stdin -> conn
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(useConn, os.Stdin)
-		// when stdin EOF, close write side if possible
-		if cw, ok := useConn.(interface{ CloseWrite() error }); ok {
-			_ = cw.CloseWrite()
+	if opts.Secure {
+		secureConn, err := connection.WrapWithAE(conn, false, opts.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("handshake error: %w", err)
 		}
-	}()
-
-	// conn -> stdout
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(os.Stdout, useConn)
-	}()
+		return secureConn, nil
+	}
+	return conn, nil
+}
 
-	wg.Wait()
+// dialCommand starts the -proxy-command, with %h and %p replaced by the
+// target's host and port, and uses its stdio as the connection.
+func dialCommand(cmdline, target string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, permanentError{fmt.Errorf("-proxy-command needs a host:port target: %w", err)}
+	}
+	cmdline = strings.NewReplacer("%h", host, "%p", port, "%%", "%").Replace(cmdline)
+	return connection.DialCommand(cmdline)
 }
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/socks"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 40; attempt++ {
+		full := min(30*time.Second, 250*time.Millisecond<<min(attempt-1, 20))
+		for range 20 {
+			if d := backoff(attempt); d < full/2 || d >= full {
+				t.Fatalf("backoff(%d) = %v, want in [%v, %v)", attempt, d, full/2, full)
+			}
+		}
+	}
+}
+
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("connection refused"), true},
+		{fmt.Errorf("handshake error: %w", connection.ErrHandshakeTimeout), true},
+		{fmt.Errorf("handshake error: %w", connection.ErrAuthFailed), false},
+		{fmt.Errorf("handshake error: server closed the connection during the handshake: %w", io.ErrUnexpectedEOF), true},
+		{socks.ErrAuthFailed, false},
+		{fmt.Errorf("connect error: %w", permanentError{errors.New("bad cert")}), false},
+	}
+	for _, tt := range tests {
+		if got := retriable(tt.err); got != tt.want {
+			t.Errorf("retriable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/socks"
+)
+
+// ParseProxy checks a -proxy URL: socks5://, socks5h:// or http://, with
+// optional user:password@. Its errors leave the password out.
+func ParseProxy(spec string) (*url.URL, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err // without the URL, which has the password in it
+		}
+		return nil, fmt.Errorf("invalid proxy %q: %w", redactProxy(spec), err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy %q (want socks5://, socks5h:// or http://)", redactProxy(spec))
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: no host", redactProxy(spec))
+	}
+	return u, nil
+}
+
+// redactProxy returns spec with the userinfo masked, also when it does not
+// parse as a URL.
+func redactProxy(spec string) string {
+	at := strings.LastIndex(spec, "@")
+	if at < 0 {
+		return spec
+	}
+	prefix := ""
+	if scheme, _, ok := strings.Cut(spec[:at], "://"); ok {
+		prefix = scheme + "://"
+	}
+	return prefix + "xxxxx@" + spec[at+1:]
+}
+
+// dialProxy connects to target through opts.Proxy. The connection it
+// returns is a plain tunnel to target; the transport handshake runs over it.
+func dialProxy(target string, opts connection.Options) (net.Conn, error) {
+	u, err := ParseProxy(opts.Proxy)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "1080"
+		if u.Scheme == "http" {
+			port = "8080"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	user, password := u.User.Username(), ""
+	if p, ok := u.User.Password(); ok {
+		password = p
+	}
+
+	conn, err := dialIP("tcp", addr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("proxy connect error: %w", err)
+	}
+	tunnel := conn
+	switch u.Scheme {
+	case "http":
+		tunnel, err = httpConnect(conn, user, password, target)
+	case "socks5":
+		// socks5:// resolves the target here, socks5h:// leaves it to the proxy
+		if target, err = resolveTarget(target, opts.Family); err == nil {
+			err = socks.Connect(conn, user, password, target)
+		}
+	case "socks5h":
+		err = socks.Connect(conn, user, password, target)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func resolveTarget(target string, family int) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	addr, err := net.ResolveIPAddr(connection.Network("ip", family), host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addr.IP.String(), port), nil
+}
+
+// httpConnect asks the HTTP proxy on conn for a tunnel to target.
+func httpConnect(conn net.Conn, user, password, target string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy reply: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, permanentError{fmt.Errorf("HTTP proxy refused our credentials: %s", resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy refused the tunnel to %s: %s", target, resp.Status)
+	}
+	// the peer may already have started talking: keep what was read ahead
+	return connection.ReadAhead(conn, br), nil
+}
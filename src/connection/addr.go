@@ -0,0 +1,66 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// SplitNetwork maps an xfer address to the network and address net.Dial
+// and net.Listen take: unix:/path and unix:@name are Unix domain sockets,
+// and so is a bare @name, an abstract socket on Linux. Anything else is a
+// TCP host:port.
+func SplitNetwork(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "@"):
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// IsUnixAddr reports whether addr names a Unix domain socket.
+func IsUnixAddr(addr string) bool {
+	network, _ := SplitNetwork(addr)
+	return network == "unix"
+}
+
+// Network narrows "tcp", "udp" or "ip" to IPv4 or IPv6 when family is 4
+// or 6.
+func Network(base string, family int) string {
+	switch family {
+	case 4:
+		return base + "4"
+	case 6:
+		return base + "6"
+	}
+	return base
+}
+
+// Listen listens on a TCP or Unix socket address, see SplitNetwork, with
+// TCP narrowed to family as in Network. A socket file nobody accepts on
+// any more, left behind by a server that was killed, is replaced.
+func Listen(addr string, family int) (net.Listener, error) {
+	network, address := SplitNetwork(addr)
+	if network == "tcp" {
+		network = Network(network, family)
+	}
+	ln, err := net.Listen(network, address)
+	if err == nil || network != "unix" || strings.HasPrefix(address, "@") || !errors.Is(err, syscall.EADDRINUSE) {
+		return ln, err
+	}
+	if c, derr := net.Dial(network, address); derr == nil {
+		_ = c.Close()
+		return nil, err // in use for real
+	}
+	if fi, serr := os.Lstat(address); serr != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil, err
+	}
+	if rerr := os.Remove(address); rerr != nil {
+		return nil, err
+	}
+	return net.Listen(network, address)
+}
@@ -0,0 +1,71 @@
+package connection
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitNetwork(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{"127.0.0.1:9999", "tcp", "127.0.0.1:9999"},
+		{"[::1]:9999", "tcp", "[::1]:9999"},
+		{"unix:/run/app.sock", "unix", "/run/app.sock"},
+		{"unix:@app", "unix", "@app"},
+		{"@app", "unix", "@app"},
+	}
+	for _, tt := range tests {
+		network, address := SplitNetwork(tt.addr)
+		if network != tt.network || address != tt.address {
+			t.Errorf("SplitNetwork(%q) = %q, %q, want %q, %q", tt.addr, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+func TestListen_ReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.sock")
+	addr := "unix:" + path
+
+	// a socket file without a listener, as a killed server leaves it
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := Listen(addr, 0)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: %v", err)
+	}
+	defer ln.Close()
+
+	// a live one is left alone
+	if _, err := Listen(addr, 0); err == nil {
+		t.Fatal("Listen took over a socket in use")
+	}
+
+	// the second Listen probed the socket by connecting, so serve every client
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte("hi"))
+			_ = c.Close()
+		}
+	}()
+	network, address := SplitNetwork(addr)
+	c, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	buf := make([]byte, 2)
+	if _, err := c.Read(buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("Read = %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,47 @@
+package connection
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// DialCommand runs cmdline through the system shell and returns its stdin
+// and stdout as a connection, like ssh's ProxyCommand. The command's stderr
+// goes to ours. Closing the connection ends the command.
+func DialCommand(cmdline string) (net.Conn, error) {
+	cmd := shellCommand(cmdline)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return RWConn(&cmdPipe{cmd: cmd, stdin: stdin, stdout: stdout}, cmdline), nil
+}
+
+// cmdPipe is a running command's stdio as an io.ReadWriteCloser.
+type cmdPipe struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (p *cmdPipe) Read(b []byte) (int, error)  { return p.stdout.Read(b) }
+func (p *cmdPipe) Write(b []byte) (int, error) { return p.stdin.Write(b) }
+
+// CloseWrite closes the command's stdin, its view of our half-close.
+func (p *cmdPipe) CloseWrite() error { return p.stdin.Close() }
+
+func (p *cmdPipe) Close() error {
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+	return p.cmd.Wait()
+}
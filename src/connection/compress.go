@@ -0,0 +1,184 @@
+package connection
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jnsoft/xfer/src/helpers"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms in order of preference.
+var compressAlgos = []string{"zstd", "gzip"}
+
+var compressMagic = []byte("XFZ1")
+
+// compressNegotiateTimeout is the limit on the negotiation when nothing else
+// bounds it: a peer without compression never answers.
+const compressNegotiateTimeout = 10 * time.Second
+
+// CompressConn compresses everything written to it and decompresses
+// everything read from it. Each Write is flushed so interactive use and
+// request/response exchanges keep working.
+type CompressConn struct {
+	net.Conn
+	algo string
+
+	wmu sync.Mutex
+	enc interface {
+		io.WriteCloser
+		Flush() error
+	}
+
+	rmu sync.Mutex
+	dec io.Reader // created on first Read: gzip reads its header eagerly
+}
+
+// CompressionAlgos parses a -C value into the list of algorithms we offer.
+func CompressionAlgos(spec string) ([]string, error) {
+	if spec == "auto" {
+		return compressAlgos, nil
+	}
+	if slices.Contains(compressAlgos, spec) {
+		return []string{spec}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q (want zstd, gzip or auto)", spec)
+}
+
+// WrapWithCompression exchanges the offered algorithms with the peer, picks
+// the most preferred one both support and wraps conn with it. It fails if
+// the peer does not negotiate, so a compressing side never silently talks
+// to a plain one. timeout bounds the negotiation; with 0 the deadline
+// already set on conn, e.g. by Handshake, applies instead and is kept.
+func WrapWithCompression(conn net.Conn, offer []string, timeout time.Duration) (*CompressConn, error) {
+	peer, err := negotiateCompression(conn, offer, timeout)
+	if err != nil {
+		return nil, err
+	}
+	algo := ""
+	for _, a := range compressAlgos {
+		if slices.Contains(offer, a) && slices.Contains(peer, a) {
+			algo = a
+			break
+		}
+	}
+	if algo == "" {
+		return nil, fmt.Errorf("no common compression: we offer %s, peer offers %s",
+			strings.Join(offer, ","), strings.Join(peer, ","))
+	}
+
+	c := &CompressConn{Conn: conn, algo: algo}
+	switch algo {
+	case "zstd":
+		enc, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		c.enc = enc
+	case "gzip":
+		c.enc = gzip.NewWriter(conn)
+	}
+	return c, nil
+}
+
+// negotiateCompression sends our offer and reads the peer's. Both sides send
+// first, so the write runs concurrently with the read.
+func negotiateCompression(conn net.Conn, offer []string, timeout time.Duration) ([]string, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	werr := make(chan error, 1)
+	go func() {
+		msg := append(bytes.Clone(compressMagic), strings.Join(offer, ",")...)
+		werr <- helpers.WriteBytesWithLen(conn, msg)
+	}()
+
+	// check the magic before trusting the length, so a plain peer's data is
+	// rejected at once instead of being waited on as a long message
+	hdr := make([]byte, 2+len(compressMagic))
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, fmt.Errorf("compression negotiation failed (is -C set on both sides?): %w", err)
+	}
+	if !bytes.Equal(hdr[2:], compressMagic) {
+		return nil, errors.New("peer did not negotiate compression (is -C set on both sides?)")
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:2])) - len(compressMagic)
+	if n < 0 {
+		return nil, errors.New("invalid compression offer")
+	}
+	list := make([]byte, n)
+	if _, err := io.ReadFull(conn, list); err != nil {
+		return nil, err
+	}
+	if err := <-werr; err != nil {
+		return nil, err
+	}
+	return strings.Split(string(list), ","), nil
+}
+
+// Algo returns the negotiated algorithm.
+func (c *CompressConn) Algo() string { return c.algo }
+
+func (c *CompressConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.enc.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.enc.Flush()
+}
+
+func (c *CompressConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.dec == nil {
+		switch c.algo {
+		case "zstd":
+			dec, err := zstd.NewReader(c.Conn, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return 0, err
+			}
+			c.dec = dec
+		case "gzip":
+			dec, err := gzip.NewReader(c.Conn)
+			if err != nil {
+				return 0, err
+			}
+			c.dec = dec
+		}
+	}
+	return c.dec.Read(p)
+}
+
+// CloseWrite finishes the compressed stream, then closes the write side of
+// the underlying connection if it supports that.
+func (c *CompressConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.enc.Close(); err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+// Close releases the decoder and closes the underlying connection.
+func (c *CompressConn) Close() error {
+	c.rmu.Lock()
+	if d, ok := c.dec.(*zstd.Decoder); ok {
+		d.Close()
+	}
+	c.rmu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,130 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func compressPair(t *testing.T, offerA, offerB []string) (*CompressConn, *CompressConn, error, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	type res struct {
+		c   *CompressConn
+		err error
+	}
+	ch := make(chan res, 1)
+	go func() {
+		c, err := WrapWithCompression(c2, offerB, compressNegotiateTimeout)
+		ch <- res{c, err}
+	}()
+	a, errA := WrapWithCompression(c1, offerA, compressNegotiateTimeout)
+	b := <-ch
+	return a, b.c, errA, b.err
+}
+
+func TestCompressConn_Negotiates(t *testing.T) {
+	a, b, errA, errB := compressPair(t, []string{"zstd", "gzip"}, []string{"gzip"})
+	if errA != nil || errB != nil {
+		t.Fatalf("negotiation failed: %v / %v", errA, errB)
+	}
+	if a.Algo() != "gzip" || b.Algo() != "gzip" {
+		t.Fatalf("picked %s/%s, want gzip", a.Algo(), b.Algo())
+	}
+}
+
+func TestCompressConn_NoCommonAlgo(t *testing.T) {
+	_, _, errA, errB := compressPair(t, []string{"zstd"}, []string{"gzip"})
+	if errA == nil || errB == nil {
+		t.Fatalf("expected both sides to fail: %v / %v", errA, errB)
+	}
+}
+
+func TestCompressConn_InteractiveAndBulk(t *testing.T) {
+	for _, algo := range compressAlgos {
+		a, b, errA, errB := compressPair(t, []string{algo}, []string{algo})
+		if errA != nil || errB != nil {
+			t.Fatalf("%s: negotiation failed: %v / %v", algo, errA, errB)
+		}
+
+		// every write must be readable on its own, without waiting for more
+		for _, msg := range []string{"ping", "pong", "{\"k\":1}"} {
+			go func() { _, _ = a.Write([]byte(msg)) }()
+			buf := make([]byte, len(msg))
+			_ = b.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(b, buf); err != nil || string(buf) != msg {
+				t.Fatalf("%s: got %q, %v want %q", algo, buf, err, msg)
+			}
+		}
+		_ = b.SetReadDeadline(time.Time{})
+
+		data := bytes.Repeat([]byte(`{"level":"info","msg":"request served"}`+"\n"), 5000)
+		go func() {
+			_, _ = a.Write(data)
+			_ = a.CloseWrite()
+			_ = a.Conn.Close()
+		}()
+		got, err := io.ReadAll(b)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: bulk transfer got %d bytes, %v", algo, len(got), err)
+		}
+	}
+}
+
+func TestCompressConn_PeerWithoutCompression(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		// a plain peer just sends its data
+		_, _ = c2.Write([]byte("hello, plain text here"))
+		_, _ = io.Copy(io.Discard, c2)
+	}()
+	if _, err := WrapWithCompression(c1, compressAlgos, compressNegotiateTimeout); err == nil {
+		t.Fatalf("expected negotiation to fail against a plain peer")
+	}
+}
+
+// With -handshake-timeout the negotiation runs under Handshake's deadline
+// and leaves it in place for the rest of the setup.
+func TestCompressConn_HandshakeTimeout(t *testing.T) {
+	opts := Options{Compress: "zstd", HandshakeTimeout: 1}
+	for _, peerNegotiates := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		if peerNegotiates {
+			go func() { _, _ = WrapWithCompression(c2, compressAlgos, compressNegotiateTimeout) }()
+		}
+
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			_, err := Handshake(c1, opts.HandshakeTimeout, func() (net.Conn, error) {
+				c, err := WrapStream(c1, opts)
+				if err != nil {
+					return nil, err
+				}
+				// a later setup step the peer never answers
+				_, err = io.ReadFull(c1, make([]byte, 1))
+				return c, err
+			})
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrHandshakeTimeout) {
+				t.Errorf("peer negotiates %v: err = %v, want ErrHandshakeTimeout", peerNegotiates, err)
+			}
+			if d := time.Since(start); d > 3*time.Second {
+				t.Errorf("peer negotiates %v: took %v, want about 1s", peerNegotiates, d)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("peer negotiates %v: handshake deadline lost", peerNegotiates)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
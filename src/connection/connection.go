@@ -1,7 +1,7 @@
 package connection
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -9,30 +9,47 @@ import (
 	"time"
 )
 
-func HandleConn(conn net.Conn, timeout int) {
-	defer conn.Close()
-	ApplyTimeout(conn, timeout)
-
+// HandleConn pumps stdin to conn and conn to stdout until both directions
+// are done. It is the default Handler. It returns the error that ended the
+// receiving side, if any (e.g. ErrDigestMismatch).
+func HandleConn(conn net.Conn) error {
 	// copy conn -> stdout and stdin -> conn
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	var rerr error
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(os.Stdout, conn)
+		_, rerr = io.Copy(os.Stdout, conn)
 	}()
 
 	go func() {
 		defer wg.Done()
 		_, _ = io.Copy(conn, os.Stdin)
 		// when stdin EOF, close write side of connection
-		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
-			_ = cw.CloseWrite()
-		}
+		_ = closeWrite(conn)
 	}()
 
 	wg.Wait()
-	fmt.Fprintf(os.Stderr, "connection closed %s\n", conn.RemoteAddr())
+	return rerr
+}
+
+// CloseWrite closes the write side of c. It returns errors.ErrUnsupported
+// if c cannot half-close, so the caller can fall back to Close.
+func CloseWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// closeWrite is CloseWrite that does nothing if c cannot half-close.
+// Wrappers use it to pass CloseWrite on.
+func closeWrite(c net.Conn) error {
+	if err := CloseWrite(c); !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	return nil
 }
 
 func ApplyTimeout(c net.Conn, timeout int) {
@@ -42,3 +59,36 @@ func ApplyTimeout(c net.Conn, timeout int) {
 	d := time.Duration(timeout) * time.Second
 	_ = c.SetDeadline(time.Now().Add(d))
 }
+
+// HandleDatagramConn pumps stdin and stdout over a datagram conn. Every stdin
+// read becomes one datagram and every datagram is written to stdout as-is.
+// There is no EOF over UDP, so it returns once receiving fails (timeout, peer
+// unreachable or conn closed); stdin EOF only stops the sending side.
+func HandleDatagramConn(conn net.Conn) error {
+	go func() {
+		_ = CopyDatagrams(conn, os.Stdin)
+	}()
+
+	_ = CopyDatagrams(os.Stdout, conn)
+	return nil
+}
+
+// CopyDatagrams copies src to dst preserving read boundaries: each successful
+// Read from src is passed to dst in a single Write.
+func CopyDatagrams(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, MaxDatagram)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package connection
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrDigestMismatch is returned by DigestConn.Read when the stream ends
+// without a trailer or with one that does not match the data received.
+var ErrDigestMismatch = errors.New("stream digest mismatch: transfer incomplete or corrupted")
+
+// DigestConn appends a digest of everything written to the stream when the
+// write side is closed, and verifies the peer's trailer on the read side.
+// The last digest-sized bytes of the incoming stream are held back until EOF,
+// so it only suits one-way streams that end with CloseWrite, like the stdio
+// pump, not request/response exchanges.
+type DigestConn struct {
+	net.Conn
+	size int
+
+	wmu sync.Mutex
+	wh  hash.Hash
+
+	rmu  sync.Mutex
+	rh   hash.Hash
+	tail []byte // received but not yet released; may be the trailer
+	eof  bool   // underlying stream ended, tail holds the trailer
+	rerr error  // sticky result once the stream has ended
+}
+
+// WrapWithDigest wraps conn with a "sha256" or "blake2b" (BLAKE2b-256)
+// integrity trailer. Both peers must use the same algorithm.
+func WrapWithDigest(conn net.Conn, algo string) (*DigestConn, error) {
+	newHash, err := digestFunc(algo)
+	if err != nil {
+		return nil, err
+	}
+	wh := newHash()
+	return &DigestConn{Conn: conn, size: wh.Size(), wh: wh, rh: newHash()}, nil
+}
+
+func digestFunc(algo string) (func() hash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New, nil
+	case "blake2b":
+		return func() hash.Hash {
+			h, _ := blake2b.New256(nil) // only fails for oversized keys
+			return h
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown digest %q (want sha256 or blake2b)", algo)
+}
+
+func (d *DigestConn) Write(p []byte) (int, error) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	n, err := d.Conn.Write(p)
+	d.wh.Write(p[:n])
+	return n, err
+}
+
+// CloseWrite sends the digest trailer, then closes the write side of the
+// underlying connection if it supports that.
+func (d *DigestConn) CloseWrite() error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if _, err := d.Conn.Write(d.wh.Sum(nil)); err != nil {
+		return err
+	}
+	return closeWrite(d.Conn)
+}
+
+// Read returns stream data minus the trailer. At the end of the stream it
+// returns io.EOF if the trailer matched, ErrDigestMismatch otherwise.
+func (d *DigestConn) Read(p []byte) (int, error) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+
+	for {
+		if len(d.tail) > d.size {
+			n := copy(p, d.tail[:len(d.tail)-d.size])
+			d.rh.Write(p[:n])
+			d.tail = append(d.tail[:0], d.tail[n:]...)
+			return n, nil
+		}
+		if d.rerr != nil {
+			return 0, d.rerr
+		}
+		if d.eof {
+			d.rerr = d.verify()
+			continue
+		}
+
+		buf := make([]byte, max(len(p), 4096))
+		n, err := d.Conn.Read(buf)
+		d.tail = append(d.tail, buf[:n]...)
+		if err == io.EOF {
+			d.eof = true
+		} else if err != nil {
+			d.rerr = err
+		}
+	}
+}
+
+func (d *DigestConn) verify() error {
+	if len(d.tail) != d.size || !hmac.Equal(d.tail, d.rh.Sum(nil)) {
+		return ErrDigestMismatch
+	}
+	return io.EOF
+}
@@ -0,0 +1,70 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// sendDigested writes data through a DigestConn and returns what the reading
+// side gets. finish decides how the writer ends the stream.
+func sendDigested(t *testing.T, algo string, data []byte, finish func(w *DigestConn, raw net.Conn)) ([]byte, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	w, err := WrapWithDigest(c1, algo)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	r, _ := WrapWithDigest(c2, algo)
+
+	go func() {
+		for _, chunk := range bytes.SplitAfter(data, []byte("\n")) {
+			_, _ = w.Write(chunk)
+		}
+		finish(w, c1)
+	}()
+	return io.ReadAll(r)
+}
+
+func TestDigestConn_RoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("line of log output\n"), 3000)
+	for _, algo := range []string{"sha256", "blake2b"} {
+		got, err := sendDigested(t, algo, data, func(w *DigestConn, raw net.Conn) {
+			_ = w.CloseWrite()
+			_ = raw.Close()
+		})
+		if err != nil {
+			t.Fatalf("%s: read error: %v", algo, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %d bytes, want %d", algo, len(got), len(data))
+		}
+	}
+}
+
+func TestDigestConn_DetectsTruncation(t *testing.T) {
+	data := bytes.Repeat([]byte("abc\n"), 100)
+	_, err := sendDigested(t, "sha256", data, func(w *DigestConn, raw net.Conn) {
+		// connection drops without the trailer
+		_ = raw.Close()
+	})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("got %v, want ErrDigestMismatch", err)
+	}
+}
+
+func TestDigestConn_DetectsCorruption(t *testing.T) {
+	data := bytes.Repeat([]byte("abc\n"), 100)
+	_, err := sendDigested(t, "sha256", data, func(w *DigestConn, raw net.Conn) {
+		// extra bytes slipped in behind the wrapper's back
+		_, _ = raw.Write([]byte("injected"))
+		_ = w.CloseWrite()
+		_ = raw.Close()
+	})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("got %v, want ErrDigestMismatch", err)
+	}
+}
@@ -0,0 +1,255 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// execMagic opens the exec protocol, so a peer that is not running -E fails
+// clearly instead of printing frames. A flags byte follows it.
+var execMagic = []byte("XFE1")
+
+// execFlagPty tells the client the command runs on a pty, so it should put
+// its terminal into raw mode and report window size changes.
+const execFlagPty byte = 1
+
+// ExitError reports a remote command that exited with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("remote command exited with status %d", e.Code)
+}
+
+// ExitCode is the status to exit with after a handler failed with err: the
+// remote command's status for an *ExitError, 1 otherwise.
+func ExitCode(err error) int {
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		return ee.Code
+	}
+	return 1
+}
+
+// ExecHandler returns a Handler that runs cmdline through the system shell
+// with its stdin and stdout bound to the connection, like nc -e. The output
+// is sent as frames so the peer (HandleExecClient) can tell stdout from
+// stderr and learn the exit status. With mergeStderr the command's stderr
+// goes into its stdout instead. The command sees XFER_PEER and XFER_LOCAL
+// set to the connection's addresses.
+func ExecHandler(cmdline string, mergeStderr bool) Handler {
+	return func(conn net.Conn) error {
+		return runExec(conn, cmdline, mergeStderr)
+	}
+}
+
+func runExec(conn net.Conn, cmdline string, mergeStderr bool) error {
+	cmd := shellCommand(cmdline)
+	cmd.Env = append(os.Environ(),
+		"XFER_PEER="+conn.RemoteAddr().String(),
+		"XFER_LOCAL="+conn.LocalAddr().String())
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr io.Reader
+	if mergeStderr {
+		cmd.Stderr = cmd.Stdout
+	} else if stderr, err = cmd.StderrPipe(); err != nil {
+		return err
+	}
+
+	fw := &frameWriter{w: conn}
+	if err := fw.write(execHello(0)); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return reportStartError(fw, cmdline, err)
+	}
+
+	// conn -> command stdin
+	go func() {
+		defer stdin.Close()
+		for {
+			f, err := ReadFrame(conn)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					// the peer is gone: nobody is left to talk to
+					_ = cmd.Process.Kill()
+				}
+				return
+			}
+			switch f.Type {
+			case FrameData:
+				if _, err := stdin.Write(f.Payload); err != nil {
+					return
+				}
+			case FrameEOF:
+				return
+			}
+		}
+	}()
+
+	// command stdout/stderr -> conn; all output must be read before Wait
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sendOutput(fw, stdout, FrameData)
+	}()
+	if stderr != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendOutput(fw, stderr, FrameStderr)
+		}()
+	}
+	wg.Wait()
+
+	return finishExec(conn, fw, cmd)
+}
+
+// sendOutput sends what the command writes to r as frames of type typ until
+// r ends. If the peer is gone it keeps draining r so the command does not
+// block on a full pipe.
+func sendOutput(fw *frameWriter, r io.Reader, typ byte) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if fw.write(Frame{Type: typ, Payload: buf[:n]}) != nil {
+				_, _ = io.Copy(io.Discard, r)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func execHello(flags byte) Frame {
+	return Frame{Type: FrameData, Payload: append(bytes.Clone(execMagic), flags)}
+}
+
+// reportStartError tells the peer the command could not be started, with
+// the status a shell uses for a command that was not found.
+func reportStartError(fw *frameWriter, cmdline string, err error) error {
+	msg := fmt.Sprintf("xfer: cannot run %q: %v\n", cmdline, err)
+	_ = fw.write(Frame{Type: FrameStderr, Payload: []byte(msg)})
+	_ = fw.write(exitFrame(127))
+	return err
+}
+
+// finishExec waits for cmd, whose output has been fully sent, and reports
+// its exit status to the peer.
+func finishExec(conn net.Conn, fw *frameWriter, cmd *exec.Cmd) error {
+	code := 0
+	if err := cmd.Wait(); err != nil {
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) {
+			return err
+		}
+		code = exitStatus(ee)
+	}
+	if err := fw.write(exitFrame(code)); err != nil {
+		return err
+	}
+	_ = closeWrite(conn)
+	return nil
+}
+
+// HandleExecClient is the peer of ExecHandler and PtyHandler: it feeds
+// stdin to the remote command and writes its stdout and stderr to ours. For
+// a command on a pty, a terminal on stdin is put into raw mode for the
+// duration and its size changes are sent along. It returns an *ExitError if
+// the command exited with a non-zero status.
+func HandleExecClient(conn net.Conn) error {
+	f, err := ReadFrame(conn)
+	if err != nil || f.Type != FrameData || len(f.Payload) != len(execMagic)+1 ||
+		!bytes.HasPrefix(f.Payload, execMagic) {
+		return errors.New("peer is not running a command (start it with -e)")
+	}
+
+	fw := &frameWriter{w: conn}
+	if f.Payload[len(execMagic)]&execFlagPty != 0 {
+		restore, err := rawTerminal(fw)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	stdin := os.Stdin
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if fw.write(Frame{Type: FrameData, Payload: buf[:n]}) != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = fw.write(Frame{Type: FrameEOF})
+				return
+			}
+		}
+	}()
+
+	for {
+		f, err := ReadFrame(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("connection closed before the remote command exited")
+			}
+			return err
+		}
+		switch f.Type {
+		case FrameData:
+			if _, err := os.Stdout.Write(f.Payload); err != nil {
+				return err
+			}
+		case FrameStderr:
+			_, _ = os.Stderr.Write(f.Payload)
+		case FrameExit:
+			if len(f.Payload) != 4 {
+				return errors.New("malformed exit frame")
+			}
+			if code := int(int32(binary.BigEndian.Uint32(f.Payload))); code != 0 {
+				return &ExitError{Code: code}
+			}
+			return nil
+		}
+	}
+}
+
+func exitFrame(code int) Frame {
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint32(p, uint32(int32(code)))
+	return Frame{Type: FrameExit, Payload: p}
+}
+
+// frameWriter serializes frames from several goroutines onto one conn.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *frameWriter) write(f Frame) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return WriteFrame(fw.w, f)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package connection
+
+import "os/exec"
+
+// shellCommand runs cmdline through cmd.exe.
+func shellCommand(cmdline string) *exec.Cmd {
+	return exec.Command("cmd.exe", "/C", cmdline)
+}
+
+// exitStatus is the status the command exited with.
+func exitStatus(ee *exec.ExitError) int {
+	return ee.ExitCode()
+}
@@ -0,0 +1,87 @@
+//go:build unix
+
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runExecPair runs handler on one end of a pipe and HandleExecClient on the
+// other, with the client's stdin reading input. It returns what the client
+// wrote to stdout and stderr and HandleExecClient's error.
+func runExecPair(t *testing.T, handler Handler, input string) (stdout, stderr string, err error) {
+	t.Helper()
+	dir := t.TempDir()
+	in := filepath.Join(dir, "stdin")
+	if err := os.WriteFile(in, []byte(input), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stdinF, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinF.Close()
+	stdoutF, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdoutF.Close()
+	stderrF, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderrF.Close()
+
+	origIn, origOut, origErr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = stdinF, stdoutF, stderrF
+	defer func() { os.Stdin, os.Stdout, os.Stderr = origIn, origOut, origErr }()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		_ = handler(c2)
+		_ = c2.Close()
+	}()
+	err = HandleExecClient(c1)
+
+	out, _ := os.ReadFile(stdoutF.Name())
+	errOut, _ := os.ReadFile(stderrF.Name())
+	return string(out), string(errOut), err
+}
+
+func TestExecHandler_RoundTrip(t *testing.T) {
+	stdout, stderr, err := runExecPair(t, ExecHandler("cat; echo oops >&2; exit 3", false), "hello\n")
+	if stdout != "hello\n" {
+		t.Errorf("stdout = %q, want the input echoed", stdout)
+	}
+	if stderr != "oops\n" {
+		t.Errorf("stderr = %q, want oops", stderr)
+	}
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.Code != 3 {
+		t.Fatalf("err = %v, want exit status 3", err)
+	}
+}
+
+func TestExecHandler_MergeStderr(t *testing.T) {
+	stdout, stderr, err := runExecPair(t, ExecHandler("echo out; echo err >&2", true), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "out\nerr\n" || stderr != "" {
+		t.Errorf("stdout = %q, stderr = %q; want both on stdout", stdout, stderr)
+	}
+}
+
+func TestExecHandler_KilledBySignal(t *testing.T) {
+	// read stdin first so the client is done with it before the kill
+	_, _, err := runExecPair(t, ExecHandler("cat >/dev/null; kill -9 $$", false), "")
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.Code != 128+9 {
+		t.Fatalf("err = %v, want exit status 137 as from a shell", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package connection
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand runs cmdline through /bin/sh.
+func shellCommand(cmdline string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", cmdline)
+}
+
+// exitStatus is the status a shell reports for ee: 128+n for a command
+// killed by signal n.
+func exitStatus(ee *exec.ExitError) int {
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ee.ExitCode()
+}
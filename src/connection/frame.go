@@ -0,0 +1,66 @@
+package connection
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frame types. A framed connection carries several logical streams (data,
+// stderr, control messages) over one byte stream.
+const (
+	FrameData   byte = 1 // payload for the stream's stdin/stdout
+	FrameStderr byte = 2 // payload for the stream's stderr
+	FrameEOF    byte = 3 // the sender will send no more data on the stream
+	FrameExit   byte = 4 // payload: exit status, int32
+	FrameResize byte = 5 // payload: terminal rows and columns, u16 each
+)
+
+// MaxFramePayload is the largest payload a single frame carries.
+const MaxFramePayload = 0xFFFF
+
+const frameHeaderLen = 1 + 4 + 2
+
+// Frame is one message on a framed connection: type u8, stream u32,
+// payload length u16, payload.
+type Frame struct {
+	Type    byte
+	Stream  uint32 // 0 when the connection carries a single stream
+	Payload []byte
+}
+
+// WriteFrame writes f in a single Write, so frames from concurrent writers
+// holding a common lock never interleave.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Payload) > MaxFramePayload {
+		return fmt.Errorf("frame payload too long: %d bytes", len(f.Payload))
+	}
+	buf := make([]byte, frameHeaderLen+len(f.Payload))
+	buf[0] = f.Type
+	binary.BigEndian.PutUint32(buf[1:], f.Stream)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(f.Payload)))
+	copy(buf[frameHeaderLen:], f.Payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one frame. A clean end of stream before the frame starts
+// returns io.EOF; one inside it returns io.ErrUnexpectedEOF.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{
+		Type:    hdr[0],
+		Stream:  binary.BigEndian.Uint32(hdr[1:]),
+		Payload: make([]byte, binary.BigEndian.Uint16(hdr[5:])),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
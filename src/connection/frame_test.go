@@ -0,0 +1,48 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: FrameData, Payload: []byte("hello")},
+		{Type: FrameStderr, Stream: 7, Payload: bytes.Repeat([]byte{0xAB}, MaxFramePayload)},
+		{Type: FrameEOF, Payload: []byte{}},
+		exitFrame(-1),
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for i, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Type != want.Type || got.Stream != want.Stream || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("frame %d: got type %d stream %d len %d, want type %d stream %d len %d",
+				i, got.Type, got.Stream, len(got.Payload), want.Type, want.Stream, len(want.Payload))
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatalf("after last frame: got %v, want io.EOF", err)
+	}
+}
+
+func TestFrame_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	_ = WriteFrame(&buf, Frame{Type: FrameData, Payload: []byte("hello")})
+	short := bytes.NewReader(buf.Bytes()[:buf.Len()-2])
+	if _, err := ReadFrame(short); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if err := WriteFrame(io.Discard, Frame{Payload: make([]byte, MaxFramePayload+1)}); err == nil {
+		t.Fatal("oversized payload accepted")
+	}
+}
@@ -0,0 +1,387 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame types used by Mux on top of FrameData and FrameEOF.
+const (
+	FrameOpen   byte = 6 // opens the stream; payload: what it is for, opaque to the mux
+	FrameClose  byte = 7 // the sender is done with the stream in both directions
+	FrameWindow byte = 8 // payload: u32 more bytes the receiver is ready for
+)
+
+const (
+	// muxWindow is how many unread bytes a stream buffers; a sender never
+	// has more than this in flight.
+	muxWindow = 256 * 1024
+	// muxChunk bounds a data frame so streams share the connection fairly.
+	muxChunk = 16 * 1024
+	// muxBacklog is how many opened streams may wait for Accept.
+	muxBacklog = 64
+)
+
+// ErrMuxClosed is returned by a Mux and its streams after Close.
+var ErrMuxClosed = errors.New("mux closed")
+
+var errStreamReset = errors.New("stream closed by peer")
+
+// Mux carries many independent byte streams over one connection as frames.
+// Either side can open streams; each has its own flow-control window so a
+// slow reader on one stream does not stall the others.
+type Mux struct {
+	conn net.Conn
+	fw   frameWriter
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // why the mux ended, set once done is closed
+
+	accept chan *Stream
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewMux starts multiplexing over conn. The two ends must pass different
+// values for client, which keeps the stream IDs they pick apart.
+func NewMux(conn net.Conn, client bool) *Mux {
+	m := &Mux{
+		conn:    conn,
+		fw:      frameWriter{w: conn},
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, muxBacklog),
+		done:    make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+	go m.readLoop()
+	return m
+}
+
+// Open starts a new stream. meta is handed to the peer's Accept, e.g. to
+// say where the stream should go.
+func (m *Mux) Open(meta []byte) (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := newStream(m, m.nextID, meta)
+	m.streams[s.id] = s
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.write(Frame{Type: FrameOpen, Stream: s.id, Payload: meta}); err != nil {
+		m.forget(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (m *Mux) Accept() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// Done is closed when the mux has ended; Err then tells why.
+func (m *Mux) Done() <-chan struct{} { return m.done }
+
+// Err returns why the mux ended: ErrMuxClosed after Close, io.EOF if the
+// peer closed the connection, or the error that broke it.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close ends all streams and closes the connection.
+func (m *Mux) Close() error {
+	m.shutdown(ErrMuxClosed)
+	return nil
+}
+
+func (m *Mux) write(f Frame) error {
+	if err := m.fw.write(f); err != nil {
+		m.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (m *Mux) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *Mux) shutdown(err error) {
+	m.once.Do(func() {
+		m.mu.Lock()
+		m.err = err
+		streams := m.streams
+		m.streams = nil
+		close(m.done)
+		m.mu.Unlock()
+
+		// streams cut off by the peer going away did not end cleanly
+		serr := err
+		if errors.Is(err, io.EOF) {
+			serr = io.ErrUnexpectedEOF
+		}
+		for _, s := range streams {
+			s.fail(serr)
+		}
+		_ = m.conn.Close()
+	})
+}
+
+func (m *Mux) readLoop() {
+	for {
+		f, err := ReadFrame(m.conn)
+		if err == nil {
+			err = m.dispatch(f)
+		}
+		if err != nil {
+			m.shutdown(err)
+			return
+		}
+	}
+}
+
+// dispatch handles one incoming frame. It never blocks on a stream's reader
+// or on writing to the connection: the loop must keep reading for window
+// updates to get through.
+func (m *Mux) dispatch(f Frame) error {
+	m.mu.Lock()
+	if m.streams == nil {
+		m.mu.Unlock()
+		return m.err
+	}
+	s := m.streams[f.Stream]
+	if f.Type == FrameOpen {
+		if s != nil || f.Stream == 0 || f.Stream%2 == m.nextID%2 {
+			m.mu.Unlock()
+			return fmt.Errorf("mux: invalid open of stream %d", f.Stream)
+		}
+		s = newStream(m, f.Stream, f.Payload)
+		m.streams[f.Stream] = s
+	}
+	m.mu.Unlock()
+	if s == nil {
+		// a stream we already closed; the peer has not seen that yet
+		return nil
+	}
+
+	switch f.Type {
+	case FrameOpen:
+		select {
+		case m.accept <- s:
+		default:
+			// nobody accepts fast enough: refuse the stream
+			go s.Close()
+		}
+	case FrameData:
+		return s.push(f.Payload)
+	case FrameEOF:
+		s.remoteEOF(false)
+	case FrameClose:
+		s.remoteEOF(true)
+		m.forget(s.id)
+	case FrameWindow:
+		if len(f.Payload) != 4 {
+			return errors.New("mux: malformed window frame")
+		}
+		s.grant(int(binary.BigEndian.Uint32(f.Payload)))
+	}
+	return nil
+}
+
+// Stream is one logical connection inside a Mux. It implements net.Conn,
+// including CloseWrite; deadlines are not supported and are ignored.
+type Stream struct {
+	m    *Mux
+	id   uint32
+	meta []byte
+
+	wmu sync.Mutex // one Write at a time, so writes are not interleaved
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      []byte // received, not read yet
+	consumed int    // read since the last window update
+	window   int    // bytes we may still send
+	eof      bool   // the peer will send no more
+	reset    bool   // the peer closed the stream
+	wclosed  bool   // we sent EOF
+	closed   bool   // we closed the stream
+	err      error  // the mux ended
+}
+
+func newStream(m *Mux, id uint32, meta []byte) *Stream {
+	s := &Stream{m: m, id: id, meta: meta, window: muxWindow}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Meta returns what the opener passed to Open.
+func (s *Stream) Meta() []byte { return s.meta }
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 {
+		switch {
+		case s.closed:
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		case s.eof:
+			s.mu.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			s.mu.Unlock()
+			return 0, s.err
+		}
+		s.cond.Wait()
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.consumed += n
+	grant := 0
+	if s.consumed >= muxWindow/2 && !s.eof {
+		grant, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+
+	if grant > 0 {
+		p := make([]byte, 4)
+		binary.BigEndian.PutUint32(p, uint32(grant))
+		_ = s.m.write(Frame{Type: FrameWindow, Stream: s.id, Payload: p})
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.window == 0 && !s.closed && !s.reset && s.err == nil {
+			s.cond.Wait()
+		}
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.wclosed:
+			err = errors.New("write after CloseWrite")
+		case s.reset:
+			err = errStreamReset
+		case s.err != nil:
+			err = s.err
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), s.window, muxChunk)
+		s.window -= n
+		s.mu.Unlock()
+
+		if err := s.m.write(Frame{Type: FrameData, Stream: s.id, Payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer we will send no more; it can still send to us.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.wclosed || s.closed || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.wclosed = true
+	s.mu.Unlock()
+	return s.m.write(Frame{Type: FrameEOF, Stream: s.id})
+}
+
+// Close ends the stream in both directions.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	reset := s.reset || s.err != nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.m.forget(s.id)
+	if reset {
+		return nil
+	}
+	return s.m.write(Frame{Type: FrameClose, Stream: s.id})
+}
+
+func (s *Stream) LocalAddr() net.Addr                { return s.m.conn.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr               { return s.m.conn.RemoteAddr() }
+func (s *Stream) SetDeadline(t time.Time) error      { return nil }
+func (s *Stream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *Stream) SetWriteDeadline(t time.Time) error { return nil }
+
+// push buffers data from the peer.
+func (s *Stream) push(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if len(s.buf)+len(p) > muxWindow {
+		return fmt.Errorf("mux: stream %d overran its window", s.id)
+	}
+	s.buf = append(s.buf, p...)
+	s.cond.Broadcast()
+	return nil
+}
+
+// remoteEOF records that the peer sent EOF, or with reset closed the stream.
+func (s *Stream) remoteEOF(reset bool) {
+	s.mu.Lock()
+	s.eof = true
+	s.reset = s.reset || reset
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) grant(n int) {
+	s.mu.Lock()
+	s.window += n
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
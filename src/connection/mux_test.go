@@ -0,0 +1,109 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func muxPair(t *testing.T) (*Mux, *Mux) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	a, b := NewMux(c1, true), NewMux(c2, false)
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+func TestMux_ManyStreams(t *testing.T) {
+	a, b := muxPair(t)
+
+	// b echoes every stream back
+	go func() {
+		for {
+			s, err := b.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(s, s)
+				_ = s.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// well past the window, so flow control has to work
+			data := bytes.Repeat([]byte(fmt.Sprintf("stream %d ", i)), 100_000)
+			s, err := a.Open([]byte(fmt.Sprint(i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			go func() {
+				_, _ = s.Write(data)
+				_ = s.CloseWrite()
+			}()
+			got, err := io.ReadAll(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- fmt.Errorf("stream %d: got %d bytes, want %d", i, len(got), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestMux_CloseAndShutdown(t *testing.T) {
+	a, b := muxPair(t)
+
+	s, err := a.Open([]byte("target"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	r, err := b.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if string(r.Meta()) != "target" {
+		t.Fatalf("meta: got %q", r.Meta())
+	}
+
+	if _, err := s.Write([]byte("last words")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = s.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "last words" {
+		t.Fatalf("after peer close: got %q, %v", got, err)
+	}
+
+	// a stream cut off by the connection going away must not look complete
+	s2, _ := a.Open(nil)
+	r2, _ := b.Accept()
+	_, _ = s2.Write([]byte("partial"))
+	_ = a.Close()
+	got, err = io.ReadAll(r2)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("after connection loss: got %q, %v; want io.ErrUnexpectedEOF", got, err)
+	}
+	if _, err := a.Open(nil); !errors.Is(err, ErrMuxClosed) {
+		t.Fatalf("open after close: got %v, want ErrMuxClosed", err)
+	}
+}
@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"net"
+	"time"
+)
+
+// Options selects the transport a server or client sets up before handing
+// the connection to a Handler.
+type Options struct {
+	Timeout  int    // I/O timeout seconds (0 = no timeout)
+	UDP      bool   // datagram transport instead of TCP
+	Secure   bool   // AES-256-GCM + ECDH transport
+	TLS      bool   // TLS 1.3 transport
+	Secret   string // optional pre-shared key for the AE handshake
+	CertFile string // TLS certificate (server) or CA certificate (client)
+	KeyFile  string // TLS private key (server)
+	Digest   string // integrity trailer algorithm for the stdio pump ("" = off)
+	Progress bool   // live progress line and summary on stderr
+	Compress string // -C value: zstd, gzip or auto ("" = off)
+	Proxy    string // socks5://, socks5h:// or http:// proxy to connect through (client)
+	ProxyCmd string // -proxy-command: its stdin/stdout is the connection (client)
+	Family   int    // 4 or 6 to use only IPv4 or IPv6 (0 = either)
+	Source   string // local host, host:port or :port to connect from (client)
+	Retry    int    // attempts after a failed connect or handshake (-1 = forever, client)
+
+	// limits in seconds on top of Timeout (0 = none)
+	Idle             int // without traffic in either direction, once set up
+	ConnectTimeout   int // to establish the TCP connection (client)
+	HandshakeTimeout int // for the TLS or AE handshake and stream layer setup
+}
+
+// Handler does the actual work on an established, wrapped connection.
+// A non-nil error makes the process exit non-zero.
+type Handler func(conn net.Conn) error
+
+// WrapStream adds the optional stream layers selected in opts on top of an
+// established, already encrypted connection. From the application down:
+// stats, digest, compression, idle timeout, then the transport, so data is compressed
+// before it is encrypted and the digest covers the uncompressed stream.
+func WrapStream(conn net.Conn, opts Options) (net.Conn, error) {
+	var idle *idleConn
+	if opts.Idle > 0 {
+		// right on the transport, which sees traffic both ways; the clock
+		// starts once the layers above are set up
+		idle = &idleConn{Conn: conn, idle: time.Duration(opts.Idle) * time.Second}
+		conn = idle
+	}
+	if opts.Compress != "" {
+		offer, err := CompressionAlgos(opts.Compress)
+		if err != nil {
+			return nil, err
+		}
+		timeout := compressNegotiateTimeout
+		if opts.HandshakeTimeout > 0 {
+			timeout = 0 // Handshake's deadline covers the negotiation
+		}
+		cc, err := WrapWithCompression(conn, offer, timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = cc
+	}
+	if opts.Digest != "" {
+		dc, err := WrapWithDigest(conn, opts.Digest)
+		if err != nil {
+			return nil, err
+		}
+		conn = dc
+	}
+	if idle != nil {
+		idle.start()
+	}
+	// outermost, so the counters see application bytes
+	return WrapWithStats(conn, opts.Progress), nil
+}
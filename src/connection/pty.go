@@ -0,0 +1,141 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// rawMode is stdin's terminal state from before rawTerminal, nil while
+// stdin is not in raw mode.
+var (
+	rawMu   sync.Mutex
+	rawMode *term.State
+)
+
+// PtyHandler returns a Handler that runs cmdline through the system shell on
+// a newly allocated pseudo-terminal bound to the connection. The peer
+// (HandleExecClient) switches its terminal to raw mode and sends window size
+// changes, so full-screen programs work. Not every platform has ptys.
+func PtyHandler(cmdline string) Handler {
+	return func(conn net.Conn) error {
+		return runPty(conn, cmdline)
+	}
+}
+
+func runPty(conn net.Conn, cmdline string) error {
+	cmd := shellCommand(cmdline)
+	cmd.Env = append(os.Environ(),
+		"XFER_PEER="+conn.RemoteAddr().String(),
+		"XFER_LOCAL="+conn.LocalAddr().String())
+	if os.Getenv("TERM") == "" {
+		cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+	}
+
+	fw := &frameWriter{w: conn}
+	if err := fw.write(execHello(execFlagPty)); err != nil {
+		return err
+	}
+	ptm, err := startPty(cmd)
+	if err != nil {
+		return reportStartError(fw, cmdline, err)
+	}
+	defer ptm.Close()
+
+	// conn -> pty
+	go func() {
+		for {
+			f, err := ReadFrame(conn)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					_ = cmd.Process.Kill()
+				}
+				return
+			}
+			switch f.Type {
+			case FrameData:
+				if _, err := ptm.Write(f.Payload); err != nil {
+					return
+				}
+			case FrameResize:
+				if len(f.Payload) == 4 {
+					rows := binary.BigEndian.Uint16(f.Payload)
+					cols := binary.BigEndian.Uint16(f.Payload[2:])
+					_ = setPtySize(ptm, rows, cols)
+				}
+			case FrameEOF:
+				// stdin was not a terminal: end it the way a user would
+				_, _ = ptm.Write([]byte{4})
+			}
+		}
+	}()
+
+	// the pty reports an error (EIO on linux) once the command has exited
+	sendOutput(fw, ptm, FrameData)
+	return finishExec(conn, fw, cmd)
+}
+
+// rawTerminal puts a terminal on stdin into raw mode, sends its size and
+// keeps sending it as it changes. The returned func undoes all of it. With
+// stdin not a terminal it does nothing.
+func rawTerminal(fw *frameWriter) (func(), error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}, nil
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	rawMu.Lock()
+	rawMode = state
+	rawMu.Unlock()
+
+	sendSize := func() {
+		cols, rows, err := term.GetSize(fd)
+		if err != nil {
+			return
+		}
+		p := make([]byte, 4)
+		binary.BigEndian.PutUint16(p, uint16(rows))
+		binary.BigEndian.PutUint16(p[2:], uint16(cols))
+		_ = fw.write(Frame{Type: FrameResize, Payload: p})
+	}
+	sendSize()
+
+	winch := notifyResize()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-winch:
+				sendSize()
+			}
+		}
+	}()
+
+	return func() {
+		stopResize(winch)
+		close(done)
+		RestoreTerminal()
+	}, nil
+}
+
+// RestoreTerminal takes a terminal on stdin out of the raw mode
+// HandleExecClient put it in, if it did. Call it before exiting from a
+// signal handler.
+func RestoreTerminal() {
+	rawMu.Lock()
+	defer rawMu.Unlock()
+	if rawMode != nil {
+		_ = term.Restore(int(os.Stdin.Fd()), rawMode)
+		rawMode = nil
+	}
+}
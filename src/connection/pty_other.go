@@ -0,0 +1,20 @@
+//go:build !unix
+
+package connection
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func startPty(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("pty mode is not supported on this platform")
+}
+
+func setPtySize(ptm *os.File, rows, cols uint16) error { return nil }
+
+// notifyResize returns a channel that never fires: there is no SIGWINCH here.
+func notifyResize() chan os.Signal { return nil }
+
+func stopResize(c chan os.Signal) {}
@@ -0,0 +1,62 @@
+//go:build unix
+
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPtyHandler_RunsOnResizedPty(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		_ = PtyHandler("read line; stty size; echo got-$line")(c2)
+		_ = c2.Close()
+	}()
+	_ = c1.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hello, err := ReadFrame(c1)
+	if err != nil || !bytes.Equal(hello.Payload, execHello(execFlagPty).Payload) {
+		t.Fatalf("hello = %v, %v; want the pty flag set", hello, err)
+	}
+	// frames are handled in order, so the size is set before the line arrives
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint16(size, 33)
+	binary.BigEndian.PutUint16(size[2:], 101)
+	if err := WriteFrame(c1, Frame{Type: FrameResize, Payload: size}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(c1, Frame{Type: FrameData, Payload: []byte("hi\n")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	for {
+		f, err := ReadFrame(c1)
+		if err != nil {
+			t.Fatalf("after %q: %v", out.String(), err)
+		}
+		if f.Type == FrameData {
+			out.Write(f.Payload)
+			continue
+		}
+		if f.Type != FrameExit {
+			t.Fatalf("unexpected frame type %d", f.Type)
+		}
+		if code := binary.BigEndian.Uint32(f.Payload); code != 0 {
+			t.Fatalf("exit status %d, output %q", code, out.String())
+		}
+		break
+	}
+	// a terminal ends lines with \r\n
+	for _, want := range []string{"33 101\r\n", "got-hi\r\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q lacks %q", out.String(), want)
+		}
+	}
+}
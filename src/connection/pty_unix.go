@@ -0,0 +1,31 @@
+//go:build unix
+
+package connection
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+// startPty starts cmd as a session leader with a new pty as its controlling
+// terminal and returns the master side.
+func startPty(cmd *exec.Cmd) (*os.File, error) {
+	return pty.Start(cmd)
+}
+
+func setPtySize(ptm *os.File, rows, cols uint16) error {
+	return pty.Setsize(ptm, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// notifyResize returns a channel that fires on SIGWINCH.
+func notifyResize() chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGWINCH)
+	return c
+}
+
+func stopResize(c chan os.Signal) { signal.Stop(c) }
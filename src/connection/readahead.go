@@ -0,0 +1,28 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+)
+
+// ReadAhead returns conn with the bytes br has already read from it served
+// first, e.g. data a proxy sent right after its reply headers. br must be
+// reading conn and is not used afterwards.
+func ReadAhead(conn net.Conn, br *bufio.Reader) net.Conn {
+	n := br.Buffered()
+	if n == 0 {
+		return conn
+	}
+	ahead, _ := br.Peek(n)
+	return &readAheadConn{Conn: conn, r: io.MultiReader(bytes.NewReader(bytes.Clone(ahead)), conn)}
+}
+
+type readAheadConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readAheadConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *readAheadConn) CloseWrite() error          { return closeWrite(c.Conn) }
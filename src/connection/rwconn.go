@@ -0,0 +1,210 @@
+package connection
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// RWConn returns rwc as a net.Conn: rwc itself if it already is one,
+// otherwise an adapter that emulates deadlines. The adapter reads ahead in
+// a goroutine so a Read can give up at its deadline; a Write that misses
+// its deadline may still complete later. CloseWrite is passed on if rwc has
+// it. name is reported as the remote address.
+func RWConn(rwc io.ReadWriteCloser, name string) net.Conn {
+	if c, ok := rwc.(net.Conn); ok {
+		return c
+	}
+	return &rwConn{
+		rwc:    rwc,
+		addr:   pipeAddr(name),
+		reads:  make(chan readResult),
+		wsem:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		rdl:    newDeadline(),
+		wdl:    newDeadline(),
+	}
+}
+
+type rwConn struct {
+	rwc  io.ReadWriteCloser
+	addr pipeAddr
+
+	rmu      sync.Mutex
+	readOnce sync.Once
+	reads    chan readResult
+	pending  []byte // rest of the last read-ahead chunk
+	rerr     error  // sticky read error
+
+	wsem chan struct{} // one Write at a time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	rdl, wdl *deadline
+}
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+func (c *rwConn) readAhead() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := c.rwc.Read(buf)
+		select {
+		case c.reads <- readResult{buf[:n], err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *rwConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.pending) == 0 && c.rerr == nil {
+		c.readOnce.Do(func() { go c.readAhead() })
+		select {
+		case r := <-c.reads:
+			c.pending, c.rerr = r.b, r.err
+		case <-c.rdl.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return 0, c.rerr
+}
+
+func (c *rwConn) Write(p []byte) (int, error) {
+	select {
+	case c.wsem <- struct{}{}:
+	case <-c.wdl.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	// the write may outlive this call, so it must not use the caller's buffer
+	b := bytes.Clone(p)
+	done := make(chan result, 1)
+	go func() {
+		n, err := c.rwc.Write(b)
+		<-c.wsem
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-c.wdl.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// CloseWrite passes the half-close on if the underlying stream supports it.
+func (c *rwConn) CloseWrite() error {
+	if cw, ok := c.rwc.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *rwConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close()
+	})
+	return err
+}
+
+func (c *rwConn) LocalAddr() net.Addr  { return pipeAddr("local") }
+func (c *rwConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *rwConn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *rwConn) SetReadDeadline(t time.Time) error  { c.rdl.set(t); return nil }
+func (c *rwConn) SetWriteDeadline(t time.Time) error { c.wdl.set(t); return nil }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// deadline is a settable point in time whose wait channel is closed once it
+// has passed.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired, wait for it to close cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,79 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// pipeRWC joins two io.Pipes into one end of a byte stream that is not a
+// net.Conn.
+type pipeRWC struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeRWC) Close() error {
+	_ = p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+func pipeRWCPair() (pipeRWC, pipeRWC) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return pipeRWC{r1, w2}, pipeRWC{r2, w1}
+}
+
+func TestRWConn_ReadDeadline(t *testing.T) {
+	a, b := pipeRWCPair()
+	c := RWConn(a, "test")
+	defer c.Close()
+	defer b.Close()
+
+	_ = c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 8)
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read err = %v, want deadline exceeded", err)
+	}
+
+	// clearing the deadline makes the conn usable again
+	_ = c.SetReadDeadline(time.Time{})
+	go func() { _, _ = b.Write([]byte("hello")) }()
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
+
+func TestWrapWithAE_OverPipes(t *testing.T) {
+	a, b := pipeRWCPair()
+
+	type result struct {
+		sc  *SecureConn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sc, err := WrapWithAE(b, true, "key")
+		done <- result{sc, err}
+	}()
+	client, err := WrapWithAE(a, false, "key")
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	defer client.Close()
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("server handshake: %v", r.err)
+	}
+	defer r.sc.Close()
+
+	go func() { _, _ = client.Write([]byte("over a pipe")) }()
+	buf := make([]byte, 32)
+	n, err := r.sc.Read(buf)
+	if err != nil || string(buf[:n]) != "over a pipe" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+}
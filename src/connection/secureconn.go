@@ -2,32 +2,79 @@ package connection
 
 import (
 	"bytes"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/hmac"
 	"crypto/rand"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jnsoft/xfer/src/helpers"
 )
 
+var (
+	// ErrAuthFailed means the peer does not have the same pre-shared key, or
+	// turned ours down. Trying again will not help.
+	ErrAuthFailed = errors.New("handshake authentication failed")
+	// ErrTruncated means the stream ended without the peer's authenticated
+	// close record: it was cut short on the way, or the peer died.
+	ErrTruncated = errors.New("secure stream truncated: no authenticated close from the peer")
+)
+
+// Record types, the first byte of every decrypted record. The type is
+// encrypted along with the data, so an attacker cannot forge a close.
+const (
+	recordData  = 0
+	recordClose = 1 // close_notify: the sender will write nothing more
+)
+
+// Records are a 4-byte big-endian length, which is authenticated as
+// associated data, and the sealed record. The nonce is not sent: it is the
+// record's sequence number in its direction, so a record that was dropped,
+// replayed or moved fails to open.
+const (
+	recordHeaderLen = 4
+	maxRecordData   = 32 * 1024 // plaintext per record, not counting the type
+)
+
+// closeNotifyTimeout bounds how long Close tries to send the close record
+// to a peer that is not reading.
+const closeNotifyTimeout = time.Second
+
 type SecureConn struct {
 	conn net.Conn
-	aead cipher.AEAD
+	send cipher.AEAD // one key per direction
+	recv cipher.AEAD
 	rbuf bytes.Buffer
 	rmu  sync.Mutex
 	wmu  sync.Mutex
+
+	rseq, wseq uint64 // sequence number of the next record, under rmu / wmu
+
+	rclosed bool  // got the peer's close record, guarded by rmu
+	rerr    error // a bad record ends the stream for good, guarded by rmu
+	wclosed bool  // sent ours, guarded by wmu
 }
 
+var errBadRecord = errors.New("secure stream: record forged, replayed or out of sequence")
+
+// Close sends the close record, unless CloseWrite already did or a Write
+// is stuck, and closes the connection.
 func (s *SecureConn) Close() error {
+	if s.wmu.TryLock() {
+		if !s.wclosed {
+			_ = s.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+			_ = s.writeRecord(recordClose, nil)
+			s.wclosed = true
+		}
+		s.wmu.Unlock()
+	}
 	return s.conn.Close()
 }
 
@@ -40,21 +87,24 @@ func (s *SecureConn) SetWriteDeadline(t time.Time) error { return s.conn.SetWrit
 // WrapWithAE performs an ECDH handshake (P-256) and returns a SecureConn.
 // isServer controls handshake ordering: server reads peer pubkey first, client writes first.
 // authKey is an optional pre-shared key string used to authenticate the handshake (mitm protection).
-func WrapWithAE(conn net.Conn, isServer bool, authKey string) (*SecureConn, error) {
-	aead, err := performECDHHandshake(conn, isServer, authKey)
+// rwc can be any byte stream, e.g. a command's stdio; see RWConn.
+func WrapWithAE(rwc io.ReadWriteCloser, isServer bool, authKey string) (*SecureConn, error) {
+	conn := RWConn(rwc, "pipe")
+	send, recv, err := performECDHHandshake(conn, isServer, authKey)
 	if err != nil {
 		return nil, err
 	}
-	return &SecureConn{conn: conn, aead: aead}, nil
+	return &SecureConn{conn: conn, send: send, recv: recv}, nil
 }
 
-func performECDHHandshake(conn net.Conn, isServer bool, authKey string) (cipher.AEAD, error) {
+// performECDHHandshake returns the AEADs for sending and receiving.
+func performECDHHandshake(conn net.Conn, isServer bool, authKey string) (send, recv cipher.AEAD, err error) {
 	curve := ecdh.P256()
 
 	// generate our private/public
 	priv, err := curve.GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	pub := priv.PublicKey()
 	pubBytes := pub.Bytes()
@@ -64,123 +114,165 @@ func performECDHHandshake(conn net.Conn, isServer bool, authKey string) (cipher.
 		// server reads peer pubkey first, then sends its pubkey
 		peerPubBytes, err = helpers.ReadBytesWithLen(conn)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if err := helpers.WriteBytesWithLen(conn, pubBytes); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	} else {
 		// client writes first, then reads
 		if err := helpers.WriteBytesWithLen(conn, pubBytes); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		peerPubBytes, err = helpers.ReadBytesWithLen(conn)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	peerPub, err := curve.NewPublicKey(peerPubBytes)
 	if err != nil {
-		return nil, errors.New("invalid peer public key")
+		return nil, nil, errors.New("invalid peer public key")
+	}
+	// a peer that only echoes would pass the auth check: ComputeAuth orders
+	// the two keys, so our own MAC reflected back verifies
+	if bytes.Equal(peerPubBytes, pubBytes) {
+		return nil, nil, errors.New("peer sent our own public key back")
 	}
 
 	// derive shared secret using ECDH
 	shared, err := priv.ECDH(peerPub)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	fmt.Println("Shared key: ", hex.EncodeToString(shared)[0:8]+"...") // for debugging
-
 	// if authKey provided, perform an authentication exchange to prevent MITM.
-	// client sends auth first, server reads and verifies then responds.
+	// client sends auth first, server reads and verifies then responds with
+	// its own, or with an empty one to say it rejected ours.
 	if authKey != "" {
 		auth, err := helpers.ComputeAuth([]byte(authKey), shared, pubBytes, peerPubBytes)
-		fmt.Println("auth: ", hex.EncodeToString(auth)[0:8]+"...") // for debugging
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if isServer {
 			// server: read client's auth, verify, then send its auth
 			peerAuth, err := helpers.ReadBytesWithLen(conn)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			if !hmac.Equal(peerAuth, auth) {
-				return nil, errors.New("handshake authentication failed")
+				_ = helpers.WriteBytesWithLen(conn, nil)
+				return nil, nil, ErrAuthFailed
 			}
 			if err := helpers.WriteBytesWithLen(conn, auth); err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 		} else {
 			// client: send auth, read server's auth and verify
 			if err := helpers.WriteBytesWithLen(conn, auth); err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			peerAuth, err := helpers.ReadBytesWithLen(conn)
+			if errors.Is(err, io.EOF) {
+				// not a verdict on our key: the server may have gone down
+				return nil, nil, fmt.Errorf("server closed the connection during the handshake: %w", io.ErrUnexpectedEOF)
+			}
 			if err != nil {
-				return nil, err
+				return nil, nil, err
+			}
+			if len(peerAuth) == 0 {
+				return nil, nil, fmt.Errorf("%w: server rejected our key", ErrAuthFailed)
 			}
 			if !hmac.Equal(peerAuth, auth) {
-				return nil, errors.New("handshake authentication failed")
+				return nil, nil, ErrAuthFailed
 			}
 		}
 	}
 
-	// derive AEAD key via HKDF, mixing shared and authKey (if present)
+	// derive one AEAD key per direction via HKDF, mixing shared and authKey (if present)
 	var salt []byte
 	if authKey != "" {
 		salt = []byte(authKey)
 	}
-	key, err := helpers.GetHkdfKey(shared, salt, []byte("xfer-v1 key"), 32)
+	c2s, err := newAEAD(shared, salt, "xfer-v2 c2s")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	block, err := aes.NewCipher(key[:])
+	s2c, err := newAEAD(shared, salt, "xfer-v2 s2c")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	if isServer {
+		return s2c, c2s, nil
 	}
-	return aead, nil
+	return c2s, s2c, nil
 }
 
 // Read implements io.Reader: reads one framed encrypted record, decrypts and serves data.
+// It returns io.EOF only after the peer's close record; a stream that ends
+// without one gives ErrTruncated.
 func (s *SecureConn) Read(p []byte) (int, error) {
 	s.rmu.Lock()
 	defer s.rmu.Unlock()
 
-	// if buffer has data, serve it
-	if s.rbuf.Len() > 0 {
-		return s.rbuf.Read(p)
+	for s.rbuf.Len() == 0 {
+		if s.rclosed {
+			return 0, io.EOF
+		}
+		if s.rerr != nil {
+			return 0, s.rerr
+		}
+		if err := s.readRecord(); err != nil {
+			if errors.Is(err, errBadRecord) {
+				s.rerr = err
+			}
+			return 0, err
+		}
 	}
+	return s.rbuf.Read(p)
+}
 
-	// read 4-byte length
-	var l uint32
-	if err := binary.Read(s.conn, binary.BigEndian, &l); err != nil {
-		return 0, err
+// readRecord reads and decrypts one record into rbuf, or notes the close.
+func (s *SecureConn) readRecord() error {
+	var hdr [recordHeaderLen]byte
+	if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+		return truncated(err)
 	}
-	if l < uint32(s.aead.NonceSize()) {
-		return 0, errors.New("invalid frame")
+	l := binary.BigEndian.Uint32(hdr[:])
+	if l < uint32(1+s.recv.Overhead()) || l > uint32(1+maxRecordData+s.recv.Overhead()) {
+		return errBadRecord
 	}
-	frame := make([]byte, int(l))
-	if _, err := io.ReadFull(s.conn, frame); err != nil {
-		return 0, err
+	ct := make([]byte, int(l))
+	if _, err := io.ReadFull(s.conn, ct); err != nil {
+		return truncated(err)
 	}
-	nonce := frame[:s.aead.NonceSize()]
-	ct := frame[s.aead.NonceSize():]
 
-	plain, err := s.aead.Open(nil, nonce, ct, nil)
+	plain, err := s.recv.Open(ct[:0], seqNonce(s.rseq), ct, hdr[:])
 	if err != nil {
-		return 0, err
+		return errBadRecord
 	}
+	s.rseq++
+	switch plain[0] {
+	case recordData:
+		s.rbuf.Write(plain[1:])
+	case recordClose:
+		s.rclosed = true
+	default:
+		return fmt.Errorf("invalid record type %d", plain[0])
+	}
+	return nil
+}
 
-	s.rbuf.Write(plain)
-	return s.rbuf.Read(p)
+// truncated maps the raw conn ending on us to ErrTruncated. Timeouts and
+// our own Close are passed on as they are.
+func truncated(err error) error {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrTruncated
+	case errors.Is(err, syscall.ECONNRESET):
+		return fmt.Errorf("%w (%v)", ErrTruncated, err)
+	}
+	return err
 }
 
 // Write encrypts and writes framed records. It returns len(p) on success.
@@ -188,29 +280,16 @@ func (s *SecureConn) Write(p []byte) (int, error) {
 	s.wmu.Lock()
 	defer s.wmu.Unlock()
 
-	const maxChunk = 32 * 1024 // 32KB plaintext per frame
+	if s.wclosed {
+		return 0, errWriteAfterClose
+	}
 	total := 0
 	for len(p) > 0 {
 		chunk := p
-		if len(chunk) > maxChunk {
-			chunk = chunk[:maxChunk]
-		}
-		nonce := make([]byte, s.aead.NonceSize())
-		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-			return total, err
+		if len(chunk) > maxRecordData {
+			chunk = chunk[:maxRecordData]
 		}
-		ct := s.aead.Seal(nil, nonce, chunk, nil)
-		frameLen := uint32(len(nonce) + len(ct))
-
-		var hdr [4]byte
-		binary.BigEndian.PutUint32(hdr[:], frameLen)
-
-		buf := make([]byte, 4+len(nonce)+len(ct))
-		copy(buf[0:4], hdr[:])
-		copy(buf[4:4+len(nonce)], nonce)
-		copy(buf[4+len(nonce):], ct)
-
-		if _, err := s.conn.Write(buf); err != nil {
+		if err := s.writeRecord(recordData, chunk); err != nil {
 			return total, err
 		}
 
@@ -220,10 +299,34 @@ func (s *SecureConn) Write(p []byte) (int, error) {
 	return total, nil
 }
 
-// CloseWrite attempts to close only the write side if underlying connection supports it.
+var errWriteAfterClose = errors.New("write after CloseWrite")
+
+// writeRecord encrypts and writes one record. The caller holds wmu.
+func (s *SecureConn) writeRecord(typ byte, data []byte) error {
+	if s.wseq == ^uint64(0) {
+		return errors.New("sequence number exhausted")
+	}
+	plain := append([]byte{typ}, data...)
+	buf := make([]byte, recordHeaderLen, recordHeaderLen+len(plain)+s.send.Overhead())
+	binary.BigEndian.PutUint32(buf, uint32(len(plain)+s.send.Overhead()))
+	buf = s.send.Seal(buf, seqNonce(s.wseq), plain, buf[:recordHeaderLen])
+	s.wseq++
+
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+// CloseWrite sends the close record, after which the peer reads io.EOF,
+// and closes the write side of the underlying connection if it can.
 func (s *SecureConn) CloseWrite() error {
-	if tcp, ok := s.conn.(interface{ CloseWrite() error }); ok {
-		return tcp.CloseWrite()
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.wclosed {
+		return nil
+	}
+	s.wclosed = true
+	if err := s.writeRecord(recordClose, nil); err != nil {
+		return err
 	}
-	return errors.New("underlying conn does not support CloseWrite")
+	return closeWrite(s.conn)
 }
@@ -1,12 +1,17 @@
 package connection
 
 import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
 	"io"
 	"net"
 	"runtime"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/jnsoft/xfer/src/helpers"
 )
 
 type wrapResult struct {
@@ -196,6 +201,10 @@ func TestSecureConn_WithAuth_MismatchedKeyFails(t *testing.T) {
 	if serverRes.err == nil && clientRes.err == nil {
 		t.Fatalf("expected authentication failure but both handshakes succeeded")
 	}
+	// the server says so, and the client can tell it from a hangup
+	if !errors.Is(clientRes.err, ErrAuthFailed) {
+		t.Fatalf("client err = %v, want ErrAuthFailed", clientRes.err)
+	}
 
 	if serverRes.conn != nil && serverRes.err == nil {
 		_ = serverRes.conn.Close()
@@ -205,3 +214,117 @@ func TestSecureConn_WithAuth_MismatchedKeyFails(t *testing.T) {
 
 	}
 }
+
+// securePair returns the two ends of an AE connection over a TCP loopback
+// conn, whose raw ends are also returned so tests can cut the stream.
+func securePair(t *testing.T) (client, server *SecureConn, rawClient, rawServer net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	rawClient, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawServer, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rawClient.Close(); rawServer.Close() })
+
+	ch := make(chan wrapResult, 2)
+	go runWrapAsync(rawServer, true, "k", "server", ch)
+	go runWrapAsync(rawClient, false, "k", "client", ch)
+	for range 2 {
+		r := <-ch
+		if r.err != nil {
+			t.Fatalf("%s handshake: %v", r.id, r.err)
+		}
+		if r.id == "server" {
+			server = r.conn.(*SecureConn)
+		} else {
+			client = r.conn.(*SecureConn)
+		}
+	}
+	return client, server, rawClient, rawServer
+}
+
+func TestSecureConn_CloseWriteIsEOF(t *testing.T) {
+	client, server, _, _ := securePair(t)
+
+	if _, err := client.Write([]byte("all of it")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "all of it" {
+		t.Fatalf("ReadAll = %q, %v; want the data and a clean EOF", got, err)
+	}
+	if _, err := client.Write([]byte("more")); err == nil {
+		t.Fatal("Write after CloseWrite succeeded")
+	}
+}
+
+func TestSecureConn_TruncationDetected(t *testing.T) {
+	client, server, rawClient, _ := securePair(t)
+
+	if _, err := client.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	// a FIN without the close record, as an attacker could inject it
+	_ = rawClient.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(server)
+	if string(got) != "partial" || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("ReadAll = %q, %v; want the data and ErrTruncated", got, err)
+	}
+}
+
+func TestSecureConn_ReplayRejected(t *testing.T) {
+	client, server, _, _ := securePair(t)
+
+	if _, err := client.Write([]byte("once")); err != nil {
+		t.Fatal(err)
+	}
+	// rewinding the sequence number sends the very same bytes again
+	client.wseq = 0
+	if _, err := client.Write([]byte("once")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "once" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	if _, err := server.Read(buf); !errors.Is(err, errBadRecord) {
+		t.Fatalf("replayed record: Read err = %v, want errBadRecord", err)
+	}
+	// the stream stays broken even if valid records follow
+	client.wseq = 2
+	go func() { _, _ = client.Write([]byte("later")) }()
+	if _, err := server.Read(buf); !errors.Is(err, errBadRecord) {
+		t.Fatalf("after a bad record: Read err = %v, want errBadRecord", err)
+	}
+}
+
+func TestSecureConn_HangupIsNotAuthFailure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		// a server that goes down mid-handshake, before it judged our key
+		_, _ = helpers.ReadBytesWithLen(c2)
+		priv, _ := ecdh.P256().GenerateKey(rand.Reader)
+		_ = helpers.WriteBytesWithLen(c2, priv.PublicKey().Bytes())
+		_, _ = helpers.ReadBytesWithLen(c2)
+		_ = c2.Close()
+	}()
+	_, err := WrapWithAE(c1, false, "key")
+	if err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err = %v, want a retriable error, not ErrAuthFailed", err)
+	}
+}
@@ -0,0 +1,407 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jnsoft/xfer/src/helpers"
+)
+
+// datagram record types (first byte of every packet)
+const (
+	dgClientHello  = 1
+	dgServerHello  = 2
+	dgClientFinish = 3
+	dgServerFinish = 4
+	dgData         = 5
+	dgAlert        = 6 // handshake rejected; unauthenticated, see errAlert
+)
+
+const (
+	dgHeaderLen  = 1 + 8 // type + sequence number
+	dgInitialRTO = 250 * time.Millisecond
+	dgMaxRTO     = 2 * time.Second
+	dgMaxTries   = 8
+	replayWindow = 64
+)
+
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+// errAlert is what a dgAlert from the peer ends the handshake with. The
+// alert is not authenticated, anyone who can send us a packet can forge
+// one, so unlike ErrAuthFailed it does not stop a client from retrying.
+var errAlert = errors.New("peer rejected the handshake (different key?)")
+
+// SecureDatagramConn is the datagram counterpart of SecureConn: every Write
+// is sealed into its own record carrying an explicit sequence number, so a
+// lost or reordered packet does not affect the others. Replayed, stale or
+// forged packets are dropped silently, as the network would drop them.
+type SecureDatagramConn struct {
+	conn net.Conn
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	wmu  sync.Mutex
+	wseq uint64
+
+	rmu    sync.Mutex
+	window replayFilter
+
+	// server only: the client finish we accepted and our answer, so a
+	// retransmitted finish (our answer got lost) can be answered again.
+	clientFinish []byte
+	serverFinish []byte
+}
+
+// WrapDatagramWithAE performs an ECDH handshake (P-256) over a datagram conn,
+// retransmitting lost handshake messages, and returns a SecureDatagramConn.
+// authKey is an optional pre-shared key, as for WrapWithAE. timeout > 0
+// limits the whole handshake; running out of it is reported as a deadline
+// error, which Handshake turns into ErrHandshakeTimeout. The handshake sets
+// its own read deadlines, so one set on conn beforehand does not apply.
+func WrapDatagramWithAE(conn net.Conn, isServer bool, authKey string, timeout time.Duration) (*SecureDatagramConn, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if isServer {
+		return serverDatagramHandshake(conn, authKey, deadline)
+	}
+	return clientDatagramHandshake(conn, authKey, deadline)
+}
+
+func clientDatagramHandshake(conn net.Conn, authKey string, deadline time.Time) (*SecureDatagramConn, error) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pubBytes := priv.PublicKey().Bytes()
+
+	reply, err := dgExchange(conn, append([]byte{dgClientHello}, pubBytes...), dgServerHello, deadline)
+	if err != nil {
+		return nil, err
+	}
+	peerPubBytes := reply[1:]
+	shared, err := dgSharedSecret(priv, peerPubBytes)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := dgAuth(authKey, shared, pubBytes, peerPubBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err = dgExchange(conn, append([]byte{dgClientFinish}, auth...), dgServerFinish, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(reply[1:], auth) {
+		return nil, ErrAuthFailed
+	}
+
+	s := &SecureDatagramConn{conn: conn}
+	if err := s.deriveKeys(shared, authKey, false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func serverDatagramHandshake(conn net.Conn, authKey string, deadline time.Time) (*SecureDatagramConn, error) {
+	hello, err := dgAwait(conn, dgClientHello, dgMaxTries*dgMaxRTO, deadline)
+	if err != nil {
+		return nil, err
+	}
+	peerPubBytes := hello[1:]
+
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pubBytes := priv.PublicKey().Bytes()
+	shared, err := dgSharedSecret(priv, peerPubBytes)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := dgAuth(authKey, shared, pubBytes, peerPubBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// resend our hello until the client's finish shows up
+	finish, err := dgExchange(conn, append([]byte{dgServerHello}, pubBytes...), dgClientFinish, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(finish[1:], auth) {
+		// tell the client, otherwise it keeps retransmitting until it gives up
+		_, _ = conn.Write([]byte{dgAlert})
+		return nil, ErrAuthFailed
+	}
+
+	s := &SecureDatagramConn{
+		conn:         conn,
+		clientFinish: finish,
+		serverFinish: append([]byte{dgServerFinish}, auth...),
+	}
+	if err := s.deriveKeys(shared, authKey, true); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(s.serverFinish); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func dgSharedSecret(priv *ecdh.PrivateKey, peerPubBytes []byte) ([]byte, error) {
+	peerPub, err := ecdh.P256().NewPublicKey(peerPubBytes)
+	if err != nil {
+		return nil, errors.New("invalid peer public key")
+	}
+	return priv.ECDH(peerPub)
+}
+
+// dgAuth returns the handshake MAC, or an empty slice when no key is set:
+// the finish messages then only mark the steps of the exchange and prove
+// nothing. A MAC that does not match is answered with a dgAlert, which is
+// not authenticated either.
+func dgAuth(authKey string, shared, localPub, peerPub []byte) ([]byte, error) {
+	if authKey == "" {
+		return []byte{}, nil
+	}
+	return helpers.ComputeAuth([]byte(authKey), shared, localPub, peerPub)
+}
+
+// deriveKeys sets up one AEAD per direction so sequence-number nonces never
+// repeat under the same key.
+func (s *SecureDatagramConn) deriveKeys(shared []byte, authKey string, isServer bool) error {
+	var salt []byte
+	if authKey != "" {
+		salt = []byte(authKey)
+	}
+	c2s, err := newAEAD(shared, salt, "xfer-v1 dgram c2s")
+	if err != nil {
+		return err
+	}
+	s2c, err := newAEAD(shared, salt, "xfer-v1 dgram s2c")
+	if err != nil {
+		return err
+	}
+	if isServer {
+		s.send, s.recv = s2c, c2s
+	} else {
+		s.send, s.recv = c2s, s2c
+	}
+	return nil
+}
+
+// newAEAD derives an AES-GCM key from the ECDH secret, with info naming its
+// purpose and direction.
+func newAEAD(shared, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := helpers.GetHkdfKey(shared, salt, []byte(info), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// dgExchange sends msg and waits for a packet of type want, retransmitting
+// msg with exponential backoff when nothing arrives in time.
+func dgExchange(conn net.Conn, msg []byte, want byte, deadline time.Time) ([]byte, error) {
+	rto := dgInitialRTO
+	for try := 0; try < dgMaxTries; try++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		reply, err := dgAwait(conn, want, rto, deadline)
+		if err == nil {
+			return reply, nil
+		}
+		if err != errHandshakeTimeout {
+			return nil, err
+		}
+		rto = min(rto*2, dgMaxRTO)
+	}
+	return nil, errHandshakeTimeout
+}
+
+// dgAwait reads packets until one of type want arrives or wait elapses,
+// returning errHandshakeTimeout, or the handshake deadline passes, returning
+// the deadline error. An alert from the peer aborts the wait.
+func dgAwait(conn net.Conn, want byte, wait time.Duration, deadline time.Time) ([]byte, error) {
+	until := time.Now().Add(wait)
+	final := !deadline.IsZero() && !until.Before(deadline)
+	if final {
+		until = deadline
+	}
+	_ = conn.SetReadDeadline(until)
+	buf := make([]byte, MaxDatagram)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !final {
+				return nil, errHandshakeTimeout
+			}
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		switch buf[0] {
+		case want:
+			return bytes.Clone(buf[:n]), nil
+		case dgAlert:
+			return nil, errAlert
+		}
+	}
+}
+
+// MaxPayload is the largest plaintext that fits in one datagram record.
+func (s *SecureDatagramConn) MaxPayload() int {
+	return MaxDatagram - dgHeaderLen - s.send.Overhead()
+}
+
+// Read returns the plaintext of the next valid data record. Like a UDP read,
+// a record larger than p is truncated.
+func (s *SecureDatagramConn) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	buf := make([]byte, MaxDatagram)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		pkt := buf[:n]
+		if n == 0 {
+			continue
+		}
+		switch pkt[0] {
+		case dgData:
+			plain, ok := s.open(pkt)
+			if !ok {
+				continue
+			}
+			return copy(p, plain), nil
+		case dgClientFinish:
+			if s.serverFinish != nil && bytes.Equal(pkt, s.clientFinish) {
+				_, _ = s.conn.Write(s.serverFinish)
+			}
+		}
+	}
+}
+
+func (s *SecureDatagramConn) open(pkt []byte) ([]byte, bool) {
+	if len(pkt) < dgHeaderLen+s.recv.Overhead() {
+		return nil, false
+	}
+	seq := binary.BigEndian.Uint64(pkt[1:dgHeaderLen])
+	if !s.window.check(seq) {
+		return nil, false
+	}
+	plain, err := s.recv.Open(nil, seqNonce(seq), pkt[dgHeaderLen:], pkt[:dgHeaderLen])
+	if err != nil {
+		return nil, false
+	}
+	s.window.accept(seq)
+	return plain, true
+}
+
+// Write seals p into one datagram record. Writes larger than MaxPayload are
+// split over several records.
+func (s *SecureDatagramConn) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	max := s.MaxPayload()
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if s.wseq == ^uint64(0) {
+			return total, errors.New("sequence number exhausted")
+		}
+		seq := s.wseq
+		s.wseq++
+
+		pkt := make([]byte, dgHeaderLen, dgHeaderLen+len(chunk)+s.send.Overhead())
+		pkt[0] = dgData
+		binary.BigEndian.PutUint64(pkt[1:], seq)
+		pkt = s.send.Seal(pkt, seqNonce(seq), chunk, pkt[:dgHeaderLen])
+
+		if _, err := s.conn.Write(pkt); err != nil {
+			return total, err
+		}
+		total += len(chunk)
+		p = p[len(chunk):]
+	}
+	return total, nil
+}
+
+// seqNonce is the GCM nonce for sequence number seq. Each direction has its
+// own key, so the numbers never repeat under one key.
+func seqNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (s *SecureDatagramConn) Close() error                       { return s.conn.Close() }
+func (s *SecureDatagramConn) LocalAddr() net.Addr                { return s.conn.LocalAddr() }
+func (s *SecureDatagramConn) RemoteAddr() net.Addr               { return s.conn.RemoteAddr() }
+func (s *SecureDatagramConn) SetDeadline(t time.Time) error      { return s.conn.SetDeadline(t) }
+func (s *SecureDatagramConn) SetReadDeadline(t time.Time) error  { return s.conn.SetReadDeadline(t) }
+func (s *SecureDatagramConn) SetWriteDeadline(t time.Time) error { return s.conn.SetWriteDeadline(t) }
+
+// replayFilter is a sliding window over the highest sequence number seen so
+// far; anything older than the window or already marked is rejected.
+type replayFilter struct {
+	top  uint64
+	bits uint64 // bit i set: top-i has been received
+	seen bool
+}
+
+func (w *replayFilter) check(seq uint64) bool {
+	if !w.seen || seq > w.top {
+		return true
+	}
+	diff := w.top - seq
+	if diff >= replayWindow {
+		return false
+	}
+	return w.bits&(1<<diff) == 0
+}
+
+func (w *replayFilter) accept(seq uint64) {
+	switch {
+	case !w.seen:
+		w.top, w.bits, w.seen = seq, 1, true
+	case seq > w.top:
+		shift := seq - w.top
+		if shift >= replayWindow {
+			w.bits = 1
+		} else {
+			w.bits = w.bits<<shift | 1
+		}
+		w.top = seq
+	default:
+		w.bits |= 1 << (w.top - seq)
+	}
+}
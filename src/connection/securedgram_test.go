@@ -0,0 +1,220 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dgramPipe is one end of an in-memory datagram link. drop decides, per
+// outgoing packet, whether the "network" loses it; sent records everything.
+type dgramPipe struct {
+	in   chan []byte
+	out  chan []byte
+	mu   sync.Mutex
+	drop func(pkt []byte) bool
+	sent [][]byte
+	dl   time.Time
+}
+
+func newDgramPipes() (*dgramPipe, *dgramPipe) {
+	a, b := make(chan []byte, 64), make(chan []byte, 64)
+	return &dgramPipe{in: a, out: b}, &dgramPipe{in: b, out: a}
+}
+
+func (d *dgramPipe) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	dl := d.dl
+	d.mu.Unlock()
+	var timeout <-chan time.Time
+	if !dl.IsZero() {
+		t := time.NewTimer(time.Until(dl))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case pkt := <-d.in:
+		return copy(p, pkt), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (d *dgramPipe) Write(p []byte) (int, error) {
+	pkt := bytes.Clone(p)
+	d.mu.Lock()
+	d.sent = append(d.sent, pkt)
+	drop := d.drop != nil && d.drop(pkt)
+	d.mu.Unlock()
+	if !drop {
+		d.out <- pkt
+	}
+	return len(p), nil
+}
+
+func (d *dgramPipe) inject(pkt []byte) { d.in <- pkt }
+
+func (d *dgramPipe) Close() error                     { return nil }
+func (d *dgramPipe) LocalAddr() net.Addr              { return &net.UDPAddr{} }
+func (d *dgramPipe) RemoteAddr() net.Addr             { return &net.UDPAddr{} }
+func (d *dgramPipe) SetDeadline(t time.Time) error    { return d.SetReadDeadline(t) }
+func (d *dgramPipe) SetWriteDeadline(time.Time) error { return nil }
+func (d *dgramPipe) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.dl = t
+	d.mu.Unlock()
+	return nil
+}
+
+// dropFirst loses the first packet of type typ and lets everything else through.
+func dropFirst(typ byte) func([]byte) bool {
+	dropped := false
+	return func(pkt []byte) bool {
+		if !dropped && pkt[0] == typ {
+			dropped = true
+			return true
+		}
+		return false
+	}
+}
+
+func dgramHandshake(t *testing.T, srv, cli net.Conn, srvKey, cliKey string) (*SecureDatagramConn, *SecureDatagramConn, error, error) {
+	t.Helper()
+	type res struct {
+		c   *SecureDatagramConn
+		err error
+	}
+	sch, cch := make(chan res, 1), make(chan res, 1)
+	go func() {
+		c, err := WrapDatagramWithAE(srv, true, srvKey, 0)
+		sch <- res{c, err}
+	}()
+	go func() {
+		c, err := WrapDatagramWithAE(cli, false, cliKey, 0)
+		cch <- res{c, err}
+	}()
+	s, c := <-sch, <-cch
+	return s.c, c.c, s.err, c.err
+}
+
+func TestSecureDatagram_HandshakeSurvivesLoss(t *testing.T) {
+	srv, cli := newDgramPipes()
+	cli.drop = dropFirst(dgClientHello)
+	srv.drop = dropFirst(dgServerFinish)
+
+	// the server reads right after its handshake, as a real server would;
+	// that is what answers the client's retransmitted finish.
+	got := make(chan string, 1)
+	go func() {
+		s, err := WrapDatagramWithAE(srv, true, "psk", 0)
+		if err != nil {
+			got <- "server handshake: " + err.Error()
+			return
+		}
+		buf := make([]byte, 64)
+		n, err := s.Read(buf)
+		if err != nil {
+			got <- "server read: " + err.Error()
+			return
+		}
+		_, _ = s.Write([]byte("pong"))
+		got <- string(buf[:n])
+	}()
+
+	c, err := WrapDatagramWithAE(cli, false, "psk", 0)
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if msg := <-got; msg != "ping" {
+		t.Fatalf("server got %q", msg)
+	}
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("client got %q, %v", buf[:n], err)
+	}
+}
+
+func TestSecureDatagram_RejectsReplay(t *testing.T) {
+	srv, cli := newDgramPipes()
+	s, c, serr, cerr := dgramHandshake(t, srv, cli, "", "")
+	if serr != nil || cerr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serr, cerr)
+	}
+
+	_, _ = c.Write([]byte("first"))
+	buf := make([]byte, 64)
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("server got %q, %v", buf[:n], err)
+	}
+
+	// replay the captured data record, then send a fresh one
+	cli.mu.Lock()
+	replayed := cli.sent[len(cli.sent)-1]
+	cli.mu.Unlock()
+	srv.inject(replayed)
+	_, _ = c.Write([]byte("second"))
+
+	n, err := s.Read(buf)
+	if err != nil || string(buf[:n]) != "second" {
+		t.Fatalf("server got %q, %v; replay not rejected", buf[:n], err)
+	}
+}
+
+func TestSecureDatagram_MismatchedKeyFails(t *testing.T) {
+	srv, cli := newDgramPipes()
+	_, _, serr, cerr := dgramHandshake(t, srv, cli, "server-key", "client-key")
+	if !errors.Is(serr, ErrAuthFailed) || cerr == nil {
+		t.Fatalf("expected both sides to fail: server=%v client=%v", serr, cerr)
+	}
+}
+
+func TestSecureDatagram_AlertIsNotAuthFailure(t *testing.T) {
+	// anyone can send the alert, so it must not stop a retrying client
+	_, cli := newDgramPipes()
+	cli.inject([]byte{dgAlert})
+	_, err := WrapDatagramWithAE(cli, false, "psk", 0)
+	if err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err = %v, want a retriable error, not ErrAuthFailed", err)
+	}
+}
+
+func TestSecureDatagram_HandshakeTimeout(t *testing.T) {
+	// nobody answers; the retransmissions alone would take about 12s
+	_, cli := newDgramPipes()
+	start := time.Now()
+	_, err := Handshake(cli, 1, func() (net.Conn, error) {
+		return WrapDatagramWithAE(cli, false, "", time.Second)
+	})
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Handshake = %v, want ErrHandshakeTimeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("gave up after %v, want about 1s", d)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	var w replayFilter
+	for _, seq := range []uint64{5, 3, 7, 100} {
+		if !w.check(seq) {
+			t.Fatalf("seq %d rejected", seq)
+		}
+		w.accept(seq)
+	}
+	for _, seq := range []uint64{5, 3, 7, 100, 36} {
+		if w.check(seq) {
+			t.Fatalf("seq %d accepted", seq)
+		}
+	}
+	if !w.check(99) || !w.check(101) {
+		t.Fatalf("fresh sequence numbers rejected")
+	}
+}
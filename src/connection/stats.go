@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jnsoft/xfer/src/helpers"
+)
+
+// StatsConn counts the bytes passing through a connection. With a live
+// display it redraws a progress line on stderr every second and prints a
+// summary when closed; either way SIGUSR1 (where available) dumps the
+// current counters.
+type StatsConn struct {
+	net.Conn
+	sent  atomic.Int64
+	recv  atomic.Int64
+	total atomic.Int64 // expected size of the transfer, 0 if unknown
+	start time.Time
+
+	out  io.Writer
+	live bool
+	stop chan struct{}
+	once sync.Once
+}
+
+// WrapWithStats wraps conn with byte counters reporting to stderr. live
+// turns on the once-a-second progress line and the summary on Close.
+func WrapWithStats(conn net.Conn, live bool) *StatsConn {
+	s := &StatsConn{
+		Conn:  conn,
+		start: time.Now(),
+		out:   os.Stderr,
+		live:  live,
+		stop:  make(chan struct{}),
+	}
+	registerStats(s)
+	if live {
+		go s.report()
+	}
+	return s
+}
+
+func (s *StatsConn) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	s.recv.Add(int64(n))
+	return n, err
+}
+
+func (s *StatsConn) Write(p []byte) (int, error) {
+	n, err := s.Conn.Write(p)
+	s.sent.Add(int64(n))
+	return n, err
+}
+
+func (s *StatsConn) CloseWrite() error { return closeWrite(s.Conn) }
+
+// ExpectTotal sets the size of the transfer so the display can show an ETA.
+func (s *StatsConn) ExpectTotal(n int64) { s.total.Store(n) }
+
+// Close stops the reporter, prints the summary line and closes the conn.
+func (s *StatsConn) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		unregisterStats(s)
+		if s.live {
+			fmt.Fprintf(s.out, "\r%s\n", s.summary())
+		}
+	})
+	return s.Conn.Close()
+}
+
+// report redraws the live progress line until Close.
+func (s *StatsConn) report() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	last, lastAt := int64(0), s.start
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			moved := s.moved()
+			rate := float64(moved-last) / now.Sub(lastAt).Seconds()
+			last, lastAt = moved, now
+			fmt.Fprintf(s.out, "\r%s", s.line(rate))
+		}
+	}
+}
+
+// dump prints the current counters on a line of their own.
+func (s *StatsConn) dump() {
+	prefix := ""
+	if s.live {
+		// move off the progress line, it is redrawn on the next tick
+		prefix = "\n"
+	}
+	fmt.Fprintf(s.out, "%s%s\n", prefix, strings.TrimRight(s.line(-1), " "))
+}
+
+// The open StatsConns, which a single process-wide SIGUSR1 handler dumps.
+var (
+	statsMu   sync.Mutex
+	openStats = make(map[*StatsConn]struct{})
+	dumpOnce  sync.Once
+)
+
+func registerStats(s *StatsConn) {
+	dumpOnce.Do(func() {
+		if sig := notifyDump(); sig != nil {
+			go dumpOnSignal(sig)
+		}
+	})
+	statsMu.Lock()
+	openStats[s] = struct{}{}
+	statsMu.Unlock()
+}
+
+func unregisterStats(s *StatsConn) {
+	statsMu.Lock()
+	delete(openStats, s)
+	statsMu.Unlock()
+}
+
+func dumpOnSignal(sig <-chan os.Signal) {
+	for range sig {
+		statsMu.Lock()
+		for s := range openStats {
+			s.dump()
+		}
+		statsMu.Unlock()
+	}
+}
+
+// moved is the progress of the transfer: whichever direction carries more.
+func (s *StatsConn) moved() int64 {
+	return max(s.sent.Load(), s.recv.Load())
+}
+
+// line formats the counters; rate < 0 leaves out the current rate.
+func (s *StatsConn) line(rate float64) string {
+	elapsed := time.Since(s.start)
+	avg := float64(s.moved()) / max(elapsed.Seconds(), 1e-9)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "sent %s  recv %s  ", helpers.FormatBytes(s.sent.Load()), helpers.FormatBytes(s.recv.Load()))
+	if rate >= 0 {
+		fmt.Fprintf(&b, "%s/s  ", helpers.FormatBytes(int64(rate)))
+	}
+	fmt.Fprintf(&b, "avg %s/s  %s", helpers.FormatBytes(int64(avg)), helpers.FormatDuration(elapsed))
+	if total := s.total.Load(); total > 0 && avg > 0 {
+		left := float64(total-s.moved()) / avg
+		fmt.Fprintf(&b, "  ETA %s", helpers.FormatDuration(time.Duration(max(left, 0)*float64(time.Second))))
+	}
+	// pad so a shorter line fully overwrites the previous one
+	return fmt.Sprintf("%-78s", b.String())
+}
+
+func (s *StatsConn) summary() string {
+	elapsed := time.Since(s.start)
+	avg := float64(s.moved()) / max(elapsed.Seconds(), 1e-9)
+	return fmt.Sprintf("sent %s, received %s in %s (avg %s/s)",
+		helpers.FormatBytes(s.sent.Load()), helpers.FormatBytes(s.recv.Load()),
+		helpers.FormatDuration(elapsed), helpers.FormatBytes(int64(avg)))
+}
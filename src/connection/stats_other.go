@@ -0,0 +1,8 @@
+//go:build !unix
+
+package connection
+
+import "os"
+
+// notifyDump returns nil: there is no SIGUSR1 here.
+func notifyDump() chan os.Signal { return nil }
@@ -0,0 +1,77 @@
+package connection
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// halfCloser records CloseWrite calls on a net.Pipe end.
+type halfCloser struct {
+	net.Conn
+	closedWrite bool
+}
+
+func (h *halfCloser) CloseWrite() error {
+	h.closedWrite = true
+	return nil
+}
+
+func TestStatsConn_Counts(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := WrapWithStats(c1, false)
+	var out bytes.Buffer
+	s.out = &out
+
+	go func() {
+		_, _ = c2.Write([]byte("hello"))
+		_, _ = io.ReadFull(c2, make([]byte, 3))
+	}()
+	if _, err := io.ReadFull(s, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if sent, recv := s.sent.Load(), s.recv.Load(); sent != 3 || recv != 5 {
+		t.Fatalf("sent %d, recv %d; want 3 and 5", sent, recv)
+	}
+
+	statsMu.Lock()
+	_, registered := openStats[s]
+	statsMu.Unlock()
+	if !registered {
+		t.Fatal("open StatsConn is not registered for SIGUSR1")
+	}
+	s.dump()
+	if line := out.String(); !strings.HasPrefix(line, "sent 3 B  recv 5 B") {
+		t.Fatalf("dump = %q", line)
+	}
+
+	dumped := out.Len()
+	_ = s.Close()
+	statsMu.Lock()
+	_, registered = openStats[s]
+	statsMu.Unlock()
+	if registered {
+		t.Fatal("closed StatsConn is still registered")
+	}
+	if out.Len() != dumped {
+		t.Fatalf("Close printed a summary without -progress: %q", out.String()[dumped:])
+	}
+}
+
+func TestStatsConn_CloseWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	h := &halfCloser{Conn: c1}
+	s := WrapWithStats(h, false)
+	defer s.Close()
+
+	if err := s.CloseWrite(); err != nil || !h.closedWrite {
+		t.Fatalf("CloseWrite = %v, forwarded = %v", err, h.closedWrite)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package connection
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDump returns a channel that fires on SIGUSR1.
+func notifyDump() chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	return c
+}
@@ -0,0 +1,159 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrConnectTimeout means the TCP connect did not complete in time.
+	ErrConnectTimeout = errors.New("connect timeout")
+	// ErrHandshakeTimeout means the TLS or AE handshake, or the setup of
+	// the stream layers after it, did not complete in time.
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+	// ErrIdleTimeout means nothing was sent or received for the -idle time.
+	ErrIdleTimeout = errors.New("idle timeout")
+)
+
+// IsTimeout reports whether err is a timeout reported by the net package.
+func IsTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Handshake runs setup, which performs the handshake on conn and returns
+// the connection to use, within timeout seconds (0 = no limit). Running
+// out of time is reported as ErrHandshakeTimeout.
+func Handshake(conn net.Conn, timeout int, setup func() (net.Conn, error)) (net.Conn, error) {
+	if timeout <= 0 {
+		return setup()
+	}
+	d := time.Duration(timeout) * time.Second
+	_ = conn.SetDeadline(time.Now().Add(d))
+	c, err := setup()
+	if err != nil {
+		if IsTimeout(err) {
+			return nil, fmt.Errorf("%w after %v", ErrHandshakeTimeout, d)
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// idleConn pushes the deadlines of the wrapped conn forward on every Read
+// and Write, so the connection fails only after idle without traffic in
+// either direction. Deadlines set through it still apply as hard limits on
+// top. Until the idle clock is started it leaves the wrapped conn's
+// deadlines alone, so one set during the handshake keeps applying.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+
+	mu        sync.Mutex
+	running   bool
+	hardRead  time.Time // deadlines set by the user, zero if none
+	hardWrite time.Time
+}
+
+// WrapWithIdle returns conn with an idle timeout, see idleConn. The clock
+// starts at once.
+func WrapWithIdle(conn net.Conn, idle time.Duration) net.Conn {
+	c := &idleConn{Conn: conn, idle: idle}
+	c.start()
+	return c
+}
+
+// start starts the idle clock.
+func (c *idleConn) start() {
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+	c.touch()
+}
+
+func (c *idleConn) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return
+	}
+	d := time.Now().Add(c.idle)
+	_ = c.Conn.SetReadDeadline(earlier(d, c.hardRead))
+	_ = c.Conn.SetWriteDeadline(earlier(d, c.hardWrite))
+}
+
+// earlier returns hard if it is set and before d, d otherwise.
+func earlier(d, hard time.Time) time.Time {
+	if !hard.IsZero() && hard.Before(d) {
+		return hard
+	}
+	return d
+}
+
+// timeoutErr maps a deadline error to ErrIdleTimeout unless it was the
+// hard deadline that passed.
+func (c *idleConn) timeoutErr(err error, hard *time.Time) error {
+	if err == nil || !IsTimeout(err) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running || !hard.IsZero() && !time.Now().Before(*hard) {
+		return err
+	}
+	return ErrIdleTimeout
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.touch()
+	n, err := c.Conn.Read(p)
+	return n, c.timeoutErr(err, &c.hardRead)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.touch()
+	n, err := c.Conn.Write(p)
+	return n, c.timeoutErr(err, &c.hardWrite)
+}
+
+func (c *idleConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.hardRead, c.hardWrite = t, t
+	running := c.running
+	c.mu.Unlock()
+	if !running {
+		return c.Conn.SetDeadline(t)
+	}
+	c.touch()
+	return nil
+}
+
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.hardRead = t
+	running := c.running
+	c.mu.Unlock()
+	if !running {
+		return c.Conn.SetReadDeadline(t)
+	}
+	c.touch()
+	return nil
+}
+
+func (c *idleConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.hardWrite = t
+	running := c.running
+	c.mu.Unlock()
+	if !running {
+		return c.Conn.SetWriteDeadline(t)
+	}
+	c.touch()
+	return nil
+}
+
+func (c *idleConn) CloseWrite() error { return closeWrite(c.Conn) }
@@ -0,0 +1,100 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleConn_ResetsOnTraffic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := WrapWithIdle(c1, 100*time.Millisecond)
+	defer conn.Close()
+
+	// a trickle that never pauses for the idle time keeps the conn alive
+	go func() {
+		for range 6 {
+			time.Sleep(40 * time.Millisecond)
+			if _, err := c2.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := range 6 {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+
+	if _, err := conn.Read(buf); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("Read after silence = %v, want ErrIdleTimeout", err)
+	}
+}
+
+func TestIdleConn_HardDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := WrapWithIdle(c1, time.Hour)
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, ErrIdleTimeout) || !IsTimeout(err) {
+		t.Fatalf("Read = %v, want the plain deadline error", err)
+	}
+}
+
+func TestHandshake_Timeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// the peer never answers
+	_, err := Handshake(c1, 1, func() (net.Conn, error) {
+		_, err := io.ReadFull(c1, make([]byte, 4))
+		return c1, err
+	})
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Handshake = %v, want ErrHandshakeTimeout", err)
+	}
+}
+
+func TestIdleConn_ReadDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := WrapWithIdle(c1, time.Hour)
+	defer conn.Close()
+	// in case the deadline is lost, so the test fails instead of hanging
+	stop := time.AfterFunc(5*time.Second, func() { _ = c2.Close() })
+	defer stop.Stop()
+
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, ErrIdleTimeout) || !IsTimeout(err) {
+		t.Fatalf("Read = %v, want the read deadline error", err)
+	}
+}
+
+func TestHandshake_TimeoutWithIdleAndCompression(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// the idle wrapper must not stretch the handshake deadline while the
+	// silent peer holds up the compression negotiation
+	opts := Options{Idle: 3, Compress: "zstd", HandshakeTimeout: 1}
+	start := time.Now()
+	_, err := Handshake(c1, opts.HandshakeTimeout, func() (net.Conn, error) {
+		return WrapStream(c1, opts)
+	})
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("Handshake = %v, want ErrHandshakeTimeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Handshake gave up after %v, want about 1s", d)
+	}
+}
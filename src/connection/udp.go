@@ -0,0 +1,197 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MaxDatagram is the largest UDP payload we read or write in one go
+// (65535 minus the IPv4 and UDP headers).
+const MaxDatagram = 65507
+
+// UDPListener demultiplexes datagrams arriving on a single packet socket into
+// per-peer connections, so UDP peers can be served like accepted TCP conns.
+// When multi is false the listener locks onto the first peer and drops
+// datagrams from anyone else.
+type UDPListener struct {
+	pc     net.PacketConn
+	multi  bool
+	accept chan *udpPeerConn
+	done   chan struct{}
+
+	mu     sync.Mutex
+	peers  map[string]*udpPeerConn
+	locked bool
+	once   sync.Once
+}
+
+// ListenUDP opens a packet socket on addr and starts demultiplexing it.
+// network is "udp", "udp4" or "udp6".
+func ListenUDP(network, addr string, multi bool) (*UDPListener, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &UDPListener{
+		pc:     pc,
+		multi:  multi,
+		accept: make(chan *udpPeerConn, 16),
+		done:   make(chan struct{}),
+		peers:  make(map[string]*udpPeerConn),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// Accept waits for a datagram from a new peer and returns a conn bound to it.
+func (l *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case p := <-l.accept:
+		return p, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *UDPListener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+// Close closes the packet socket and every peer conn derived from it.
+func (l *UDPListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.pc.Close()
+		l.mu.Lock()
+		for _, p := range l.peers {
+			p.closeLocal()
+		}
+		l.peers = nil
+		l.mu.Unlock()
+	})
+	return err
+}
+
+func (l *UDPListener) readLoop() {
+	defer l.Close()
+	buf := make([]byte, MaxDatagram)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// transient errors (e.g. ICMP unreachable reported on the socket)
+			continue
+		}
+		p := l.peer(addr)
+		if p == nil {
+			continue
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case p.in <- pkt:
+		default:
+			// receiver is not keeping up; drop like the kernel would
+		}
+	}
+}
+
+// peer returns the conn for addr, registering a new one if allowed.
+func (l *UDPListener) peer(addr net.Addr) *udpPeerConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peers == nil {
+		return nil
+	}
+	key := addr.String()
+	if p, ok := l.peers[key]; ok {
+		return p
+	}
+	if l.locked {
+		return nil
+	}
+	p := &udpPeerConn{l: l, addr: addr, in: make(chan []byte, 64), done: make(chan struct{}), rdl: newDeadline()}
+	select {
+	case l.accept <- p:
+	default:
+		return nil
+	}
+	l.peers[key] = p
+	if !l.multi {
+		l.locked = true
+	}
+	return p
+}
+
+func (l *UDPListener) forget(p *udpPeerConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peers != nil && l.peers[p.addr.String()] == p {
+		delete(l.peers, p.addr.String())
+	}
+}
+
+// udpPeerConn is a net.Conn view of one remote address on a shared socket.
+// Each Read returns exactly one datagram.
+type udpPeerConn struct {
+	l    *UDPListener
+	addr net.Addr
+	in   chan []byte
+	done chan struct{}
+	once sync.Once
+
+	rdl *deadline // also moves for a Read that is already waiting
+}
+
+func (p *udpPeerConn) Read(b []byte) (int, error) {
+	timeout := p.rdl.wait()
+	if isClosed(timeout) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	select {
+	case pkt := <-p.in:
+		return copy(b, pkt), nil
+	case <-p.done:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *udpPeerConn) Write(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return p.l.pc.WriteTo(b, p.addr)
+}
+
+func (p *udpPeerConn) Close() error {
+	p.closeLocal()
+	p.l.forget(p)
+	return nil
+}
+
+func (p *udpPeerConn) closeLocal() {
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *udpPeerConn) LocalAddr() net.Addr  { return p.l.pc.LocalAddr() }
+func (p *udpPeerConn) RemoteAddr() net.Addr { return p.addr }
+
+func (p *udpPeerConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *udpPeerConn) SetReadDeadline(t time.Time) error {
+	p.rdl.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes on a packet socket do not block.
+func (p *udpPeerConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,109 @@
+package connection
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPListener_LocksOntoFirstPeer(t *testing.T) {
+	ln, err := ListenUDP("udp", "127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	first, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	second, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+
+	if _, err := first.Write([]byte("one")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if peer.RemoteAddr().String() != first.LocalAddr().String() {
+		t.Fatalf("accepted %s, want %s", peer.RemoteAddr(), first.LocalAddr())
+	}
+
+	// datagrams from another peer must be ignored once locked
+	_, _ = second.Write([]byte("intruder"))
+	_, _ = first.Write([]byte("two"))
+
+	_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, MaxDatagram)
+	for _, want := range []string{"one", "two"} {
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("got %q want %q", buf[:n], want)
+		}
+	}
+
+	// replies go back to the locked peer only
+	if _, err := peer.Write([]byte("reply")); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	_ = first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := first.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("first got %q, %v", buf[:n], err)
+	}
+}
+
+func TestUDPListener_ReadDeadline(t *testing.T) {
+	ln, err := ListenUDP("udp", "127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	c, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte("x"))
+
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	buf := make([]byte, 16)
+	if _, err := peer.Read(buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peer.Read(buf); err == nil {
+		t.Fatalf("expected deadline error")
+	}
+
+	// a deadline set while a Read is waiting applies to that Read
+	_ = peer.SetReadDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := peer.Read(buf)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	select {
+	case err := <-done:
+		if !IsTimeout(err) {
+			t.Fatalf("waiting Read = %v, want the deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting Read ignored the new deadline")
+	}
+}
@@ -0,0 +1,86 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/socks"
+)
+
+// DynamicHandler returns the Handler for the client end of a dynamic
+// forward: it runs a SOCKS5 proxy on listen and has the server make every
+// requested connection, tunneled over the session. listen without a host
+// means loopback. The proxy stops when the session ends.
+func DynamicHandler(listen string) connection.Handler {
+	if !strings.Contains(listen, ":") {
+		listen = "127.0.0.1:" + listen
+	}
+	return func(conn net.Conn) error {
+		m := connection.NewMux(conn, true)
+		defer m.Close()
+
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		fmt.Fprintf(os.Stderr, "SOCKS5 proxy on %s through %s\n", ln.Addr(), conn.RemoteAddr())
+
+		go func() {
+			<-m.Done()
+			_ = ln.Close()
+		}()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-m.Done():
+					if errors.Is(m.Err(), io.EOF) {
+						return errors.New("server closed the tunnel")
+					}
+					return m.Err()
+				default:
+					return err
+				}
+			}
+			go proxyConn(m, c)
+		}
+	}
+}
+
+// proxyConn serves one SOCKS client.
+func proxyConn(m *connection.Mux, c net.Conn) {
+	defer c.Close()
+	target, err := socks.ReadRequest(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "socks %s: %v\n", c.RemoteAddr(), err)
+		return
+	}
+	s, err := m.Open([]byte(reqConnect + target))
+	if err != nil {
+		_ = socks.WriteReply(c, socks.GeneralFailure, nil)
+		return
+	}
+	defer s.Close()
+
+	if _, err := readReply(s); err != nil {
+		code := socks.GeneralFailure
+		var re *RequestError
+		if errors.As(err, &re) {
+			code = re.Code
+		}
+		fmt.Fprintf(os.Stderr, "socks %s: %s: %v\n", c.RemoteAddr(), target, err)
+		_ = socks.WriteReply(c, code, nil)
+		return
+	}
+	// the server's address is of no use to the client; report ours
+	if err := socks.WriteReply(c, socks.Succeeded, c.LocalAddr()); err != nil {
+		return
+	}
+	_ = Splice(c, s)
+}
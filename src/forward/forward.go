@@ -0,0 +1,74 @@
+// Package forward relays connections between two sockets, each of which can
+// have its own transport, so a plaintext service can be reached through an
+// encrypted xfer leg or the other way round.
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/jnsoft/xfer/src/client"
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// Transport modes for one leg of a forward.
+const (
+	ModePlain = "plain"
+	ModeAE    = "ae"
+	ModeTLS   = "tls"
+)
+
+// LegOptions returns base with the transport set to mode.
+func LegOptions(base connection.Options, mode string) (connection.Options, error) {
+	base.Secure, base.TLS = false, false
+	switch mode {
+	case ModePlain:
+	case ModeAE:
+		base.Secure = true
+	case ModeTLS:
+		base.TLS = true
+	default:
+		return base, fmt.Errorf("unknown transport %q (want plain, ae or tls)", mode)
+	}
+	return base, nil
+}
+
+// Handler returns a Handler that dials target with opts and splices the
+// accepted connection to it.
+func Handler(target string, opts connection.Options) connection.Handler {
+	return func(conn net.Conn) error {
+		out, err := client.Dial(target, opts)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		return Splice(conn, out)
+	}
+}
+
+// Splice copies a to b and b to a until both directions are done, passing
+// on a half-close from either side. It returns the first error other than
+// the connections being closed.
+func Splice(a, b net.Conn) error {
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	pipe := func(i int, dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if errors.Is(connection.CloseWrite(dst), errors.ErrUnsupported) {
+			// no half-close: the other direction cannot finish on its own
+			_ = dst.Close()
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs[i] = err
+		}
+	}
+	wg.Add(2)
+	go pipe(0, b, a)
+	go pipe(1, a, b)
+	wg.Wait()
+	return errors.Join(errs...)
+}
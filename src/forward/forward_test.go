@@ -0,0 +1,210 @@
+package forward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/socks"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { c.Close(); s.Close() })
+	return c, s
+}
+
+func TestSplice_HalfClose(t *testing.T) {
+	user, a := tcpPair(t)
+	b, service := tcpPair(t)
+
+	done := make(chan error, 1)
+	go func() { done <- Splice(a, b) }()
+
+	// request, then half-close: the service must see EOF and still be able
+	// to answer
+	if _, err := user.Write([]byte("request")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = user.(*net.TCPConn).CloseWrite()
+	req, err := io.ReadAll(service)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("service got %q, %v", req, err)
+	}
+
+	if _, err := service.Write([]byte("response")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = service.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(user)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("user got %q, %v", resp, err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("splice: %v", err)
+	}
+}
+
+func TestLegOptions(t *testing.T) {
+	for mode, want := range map[string][2]bool{
+		ModePlain: {false, false},
+		ModeAE:    {true, false},
+		ModeTLS:   {false, true},
+	} {
+		opts, err := LegOptions(connection.Options{Secure: true, TLS: true}, mode)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if opts.Secure != want[0] || opts.TLS != want[1] {
+			t.Fatalf("%s: got secure=%v tls=%v", mode, opts.Secure, opts.TLS)
+		}
+	}
+	if _, err := LegOptions(connection.Options{}, "ssh"); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+}
+
+func TestParseRemoteSpec(t *testing.T) {
+	for spec, want := range map[string][2]string{
+		"8080:localhost:80":         {"127.0.0.1:8080", "localhost:80"},
+		"0.0.0.0:8080:10.0.0.7:22":  {"0.0.0.0:8080", "10.0.0.7:22"},
+		"8080:[::1]:80":             {"127.0.0.1:8080", "[::1]:80"},
+		"[::]:8080:db.internal:543": {"[::]:8080", "db.internal:543"},
+	} {
+		listen, target, err := ParseRemoteSpec(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if listen != want[0] || target != want[1] {
+			t.Fatalf("%s: got %s -> %s, want %s -> %s", spec, listen, target, want[0], want[1])
+		}
+	}
+	for _, spec := range []string{"8080", "localhost:80", ":80"} {
+		if _, _, err := ParseRemoteSpec(spec); err == nil {
+			t.Fatalf("%s: accepted", spec)
+		}
+	}
+}
+
+// tunnelConnect asks a tunnel server, run with allowLocal, to connect to addr
+// and returns its answer.
+func tunnelConnect(t *testing.T, allowLocal bool, addr string) (string, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	go func() { _ = TunnelHandler(allowLocal)(c2) }()
+	m := connection.NewMux(c1, true)
+	t.Cleanup(func() { m.Close() })
+
+	s, err := m.Open([]byte(reqConnect + addr))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	return readReply(s)
+}
+
+func TestTunnel_LocalTargets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for _, addr := range []string{ln.Addr().String(), "localhost:" + port, "[::ffff:127.0.0.1]:" + port} {
+		_, err := tunnelConnect(t, false, addr)
+		var re *RequestError
+		if !errors.As(err, &re) || re.Code != socks.NotAllowed {
+			t.Errorf("connect %s = %v, want refused as not allowed", addr, err)
+		}
+	}
+	if _, err := tunnelConnect(t, true, ln.Addr().String()); err != nil {
+		t.Errorf("connect with allowLocal = %v", err)
+	}
+}
+
+// reverseForward runs a reverse forward with opts through a tunnel server
+// to a target that greets, and returns what a connection to the forwarded
+// port receives.
+func reverseForward(t *testing.T, opts connection.Options) string {
+	t.Helper()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(c, "hi")
+			_ = c.Close()
+		}
+	}()
+	// a port that was just free is most likely still free
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := free.Addr().String()
+	_ = free.Close()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() { _ = TunnelHandler(true)(c2) }()
+	go func() { _ = ReverseHandler(listen, target.Addr().String(), opts)(c1) }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		c, err := net.Dial("tcp", listen)
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("forwarded port never opened: %v", err)
+			}
+			continue
+		}
+		defer c.Close()
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, _ := io.ReadAll(c)
+		return string(b)
+	}
+}
+
+func TestReverse_DialOptions(t *testing.T) {
+	if got := reverseForward(t, connection.Options{}); got != "hi" {
+		t.Fatalf("got %q through the forward", got)
+	}
+	// the IPv4 target is out of reach with -6
+	if got := reverseForward(t, connection.Options{Family: 6}); got != "" {
+		t.Fatalf("got %q through the forward with -6", got)
+	}
+}
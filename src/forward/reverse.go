@@ -0,0 +1,85 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// ParseRemoteSpec splits an -R spec, [bind:]port:host:hostport, into the
+// address the server listens on and the target the client connects to.
+// Without a bind address the server listens on loopback only, as ssh does.
+func ParseRemoteSpec(spec string) (listen, target string, err error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid -R %q: want [bind:]port:host:hostport", spec)
+	}
+	j := strings.LastIndex(spec[:i], ":")
+	if strings.HasSuffix(spec[:i], "]") {
+		j = strings.LastIndex(spec[:i], "[") - 1
+	}
+	if j < 1 {
+		return "", "", fmt.Errorf("invalid -R %q: want [bind:]port:host:hostport", spec)
+	}
+	listen, target = spec[:j], spec[j+1:]
+	if !strings.Contains(listen, ":") {
+		listen = "127.0.0.1:" + listen
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", "", fmt.Errorf("invalid -R target %q: %w", target, err)
+	}
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return "", "", fmt.Errorf("invalid -R listen address %q: %w", listen, err)
+	}
+	return listen, target, nil
+}
+
+// ReverseHandler returns the Handler for the client end of a reverse
+// forward: it asks the server to listen on listen and connects every
+// stream the server opens to target, over the address family and within
+// the connect timeout that opts select.
+func ReverseHandler(listen, target string, opts connection.Options) connection.Handler {
+	d := net.Dialer{Timeout: time.Duration(opts.ConnectTimeout) * time.Second}
+	network := connection.Network("tcp", opts.Family)
+	return func(conn net.Conn) error {
+		m := connection.NewMux(conn, true)
+		defer m.Close()
+
+		ctl, err := m.Open([]byte(reqListen + listen))
+		if err != nil {
+			return err
+		}
+		addr, err := readReply(ctl)
+		if err != nil {
+			return fmt.Errorf("server refused to forward: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "server listening on %s, forwarding to %s\n", addr, target)
+
+		for {
+			s, err := m.Accept()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return errors.New("server closed the tunnel")
+				}
+				return err
+			}
+			go func() {
+				defer s.Close()
+				out, err := d.Dial(network, target)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "forward from %s: %v\n", s.Meta(), err)
+					return
+				}
+				defer out.Close()
+				fmt.Fprintf(os.Stderr, "forwarding %s to %s\n", s.Meta(), target)
+				_ = Splice(s, out)
+			}()
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/socks"
+)
+
+// A tunnel session is one connection carrying a Mux. The client opens a
+// stream per request, with the request as the stream's meta:
+//
+//	listen <addr>   the server listens on addr; for every connection there
+//	                it opens a stream back, meta the connecting address
+//	connect <addr>  the server dials addr and splices the stream to it
+//
+// The server answers each request on its stream with one line, "ok <addr>"
+// (the address listened on or connected from) or "error <code> <reason>"
+// with code a SOCKS5 reply code. A listen stream stays open for the session.
+const (
+	reqListen  = "listen "
+	reqConnect = "connect "
+)
+
+// TunnelHandler returns the server end of a tunnel session: it carries out
+// the client's listen and connect requests until the client goes away.
+// Connect requests for the server's own loopback, link-local or unspecified
+// addresses are refused unless allowLocal is set.
+func TunnelHandler(allowLocal bool) connection.Handler {
+	return func(conn net.Conn) error {
+		return serveTunnel(conn, allowLocal)
+	}
+}
+
+func serveTunnel(conn net.Conn, allowLocal bool) error {
+	m := connection.NewMux(conn, false)
+	defer m.Close()
+
+	for {
+		s, err := m.Accept()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		meta := string(s.Meta())
+		if addr, ok := strings.CutPrefix(meta, reqListen); ok {
+			go serveListen(m, s, addr)
+		} else if addr, ok := strings.CutPrefix(meta, reqConnect); ok {
+			go serveConnect(s, addr, allowLocal)
+		} else {
+			writeError(s, socks.CommandNotSupported, fmt.Errorf("unknown request %q", meta))
+			_ = s.Close()
+		}
+	}
+}
+
+// serveListen listens on addr and tunnels every connection there back to
+// the client, until the session ends.
+func serveListen(m *connection.Mux, ctl *connection.Stream, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		writeError(ctl, socks.GeneralFailure, err)
+		_ = ctl.Close()
+		return
+	}
+	defer ln.Close()
+	fmt.Fprintf(ctl, "ok %s\n", ln.Addr())
+	fmt.Fprintf(os.Stderr, "forwarding %s to %s\n", ln.Addr(), ctl.RemoteAddr())
+
+	go func() {
+		<-m.Done()
+		_ = ln.Close()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			s, err := m.Open([]byte(c.RemoteAddr().String()))
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			_ = Splice(c, s)
+		}()
+	}
+}
+
+// errLocalTarget refuses a connect request for an address on the server
+// itself, e.g. a service bound to loopback that is not meant to be reached
+// from outside.
+var errLocalTarget = errors.New("connecting to the server's local addresses is not allowed (see -tunnel-local)")
+
+// serveConnect dials addr for the client and splices s to it.
+func serveConnect(s *connection.Stream, addr string, allowLocal bool) {
+	defer s.Close()
+	d := net.Dialer{}
+	if !allowLocal {
+		// checked on the resolved address, so a name for 127.0.0.1 is no way around it
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			if ap, err := netip.ParseAddrPort(address); err == nil && isLocal(ap.Addr()) {
+				return errLocalTarget
+			}
+			return nil
+		}
+	}
+	out, err := d.Dial("tcp", addr)
+	if errors.Is(err, errLocalTarget) {
+		writeError(s, socks.NotAllowed, errLocalTarget)
+		return
+	}
+	if err != nil {
+		writeError(s, socks.ReplyCode(err), err)
+		return
+	}
+	defer out.Close()
+	fmt.Fprintf(s, "ok %s\n", out.LocalAddr())
+	_ = Splice(s, out)
+}
+
+func isLocal(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+func writeError(w io.Writer, code byte, err error) {
+	fmt.Fprintf(w, "error %d %s\n", code, strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// RequestError is the server's answer to a failed request.
+type RequestError struct {
+	Code   byte // SOCKS5 reply code
+	Reason string
+}
+
+func (e *RequestError) Error() string { return e.Reason }
+
+// readReply reads the server's answer to a request. It reads byte by byte:
+// the stream's data follows right after the line.
+func readReply(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("no answer from the server (is it running -tunnel?): %w", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	reply := string(line)
+	if addr, ok := strings.CutPrefix(reply, "ok "); ok {
+		return addr, nil
+	}
+	var code byte
+	var reason string
+	if _, err := fmt.Sscanf(reply, "error %d", &code); err != nil {
+		return "", fmt.Errorf("bad answer from the server: %q", reply)
+	}
+	if _, rest, ok := strings.Cut(strings.TrimPrefix(reply, "error "), " "); ok {
+		reason = rest
+	}
+	return "", &RequestError{Code: code, Reason: reason}
+}
@@ -109,10 +109,10 @@ func WriteBytesWithLen(w io.Writer, b []byte) error {
 	if len(b) > 0xFFFF {
 		return errors.New("message too long")
 	}
-	l := uint16(len(b))
-	if err := binary.Write(w, binary.BigEndian, l); err != nil {
-		return err
-	}
-	_, err := w.Write(b)
+	// single write: an empty trailing Write would block on synchronous pipes
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
 	return err
 }
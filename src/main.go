@@ -3,43 +3,124 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/jnsoft/xfer/src/client"
+	"github.com/jnsoft/xfer/src/connection"
+	"github.com/jnsoft/xfer/src/forward"
+	"github.com/jnsoft/xfer/src/scan"
 	"github.com/jnsoft/xfer/src/server"
+	"github.com/jnsoft/xfer/src/transfer"
 )
 
 var (
 	flagListen  = flag.Bool("l", false, "listen mode (server)")
-	flagPort    = flag.Int("p", 9999, "port to listen on or connect to")
+	flagPort    = flag.Int("p", 9999, "port to listen on or connect to (0 = any free port, server)")
+	flagBind    = flag.String("b", "", "address to listen on, an IP, a host or unix:/path (server, default: all)")
+	flagIPv4    = flag.Bool("4", false, "use IPv4 only")
+	flagIPv6    = flag.Bool("6", false, "use IPv6 only")
+	flagSource  = flag.String("source", "", "local address to connect from: host, host:port or :port (client)")
 	flagKeep    = flag.Bool("k", false, "keep listening after a connection closes (server)")
+	flagConc    = flag.Bool("c", false, "serve connections concurrently instead of one after another (server)")
+	flagMaxConn = flag.Int("max-conns", 0, "with -c, reject connections beyond this many active ones (0 = no limit)")
+	flagPolicy  = flag.String("policy", server.PolicyFirst, "with -c, how connections share stdin/stdout: first, rr or files")
+	flagInetd   = flag.Bool("inetd", false, "serve the socket inetd passes as stdin/stdout instead of listening (server)")
+	flagHub     = flag.Bool("hub", false, "relay what each client sends to all other clients, server stdin to all (server, implies -c)")
+	flagLabel   = flag.Bool("label", false, "with -hub, relay line by line with the sender's address in front")
+	flagExec    = flag.String("e", "", "run this shell command with its stdin/stdout bound to the connection (peer uses -E)")
+	flagExecCli = flag.Bool("E", false, "talk to a command started with -e on the other side and exit with its status")
+	flagPty     = flag.Bool("pty", false, "run the -e command (default: $SHELL) on a pseudo-terminal, for interactive programs")
+	flagMerge   = flag.Bool("merge-stderr", false, "with -e, send the command's stderr as part of its stdout")
+	flagInsExec = flag.Bool("insecure-exec", false, "with -l, run the -e or -pty command for clients that are not authenticated (trusted networks only)")
+	flagUDP     = flag.Bool("u", false, "use UDP instead of TCP (one datagram per stdin read)")
 	flagTimeout = flag.Int("t", 0, "I/O timeout seconds (0 = no timeout)")
+	flagIdle    = flag.Int("idle", 0, "drop the connection after this many seconds without traffic (0 = never)")
+	flagConnTO  = flag.Int("connect-timeout", 0, "seconds to wait for the connection to be established (client, 0 = system default)")
+	flagHandTO  = flag.Int("handshake-timeout", 0, "seconds the TLS or AE handshake may take (0 = no limit)")
 	flagSecure  = flag.Bool("s", false, "use secure AES-256-GCM + ECDH transport")
 	flagAuth    = flag.String("a", "", "optional pre-shared key to authenticate the handshake (mitm protection)")
 	flagTLS     = flag.Bool("tls", false, "use TLS 1.3 transport")
 	flagCert    = flag.String("cert", "", "TLS certificate file (required for TLS)")
 	flagKey     = flag.String("key", "", "TLS private key file (server, required for TLS)")
+	flagDigest  = flag.String("digest", "", "append and verify an end-to-end digest of the stream: sha256 or blake2b (both sides)")
+	flagComp    = flag.String("C", "", "compress the stream: zstd, gzip or auto (both sides)")
+	flagProg    = flag.Bool("P", false, "show live progress and a transfer summary on stderr")
+	flagOut     = flag.String("o", ".", "directory to write received files to (recv, or -c -policy files)")
+	flagForce   = flag.Bool("f", false, "overwrite existing files (recv)")
+	flagLocal   = flag.String("L", "", "local address to accept connections on (forward)")
+	flagIn      = flag.String("in", forward.ModePlain, "transport of accepted connections: plain, ae or tls (forward)")
+	flagOutTr   = flag.String("out", forward.ModePlain, "transport of connections to the target: plain, ae or tls (forward)")
+	flagRemote  = flag.String("R", "", "ask the server to listen on [bind:]port and tunnel connections back to host:hostport (client)")
+	flagDynamic = flag.String("D", "", "run a SOCKS5 proxy on [bind:]port whose connections the server makes (client)")
+	flagTunnel  = flag.Bool("tunnel", false, "let clients forward through this server with -R and -D (server, implies -c, needs -tls or -s -a key)")
+	flagTunLoc  = flag.Bool("tunnel-local", false, "with -tunnel, let clients connect to this host's loopback and link-local addresses")
+	flagRetry   = flag.Int("retry", 0, "on a failed connect or handshake, try again this many times with backoff (client)")
+	flagRetryF  = flag.Bool("retry-forever", false, "like -retry, without giving up (client)")
+	flagProxy   = flag.String("proxy", "", "connect through a proxy: socks5://[user:pass@]host:port, socks5h://... or http://[user:pass@]host:port (client)")
+	flagProxyC  = flag.String("proxy-command", "", "connect over the stdin/stdout of this shell command, %h and %p are the target's host and port (client)")
+	flagScan    = flag.Bool("z", false, "scan: report which of the given ports accept connections, exit 1 unless all do (client)")
+	flagProbe   = flag.Bool("probe", false, "with -z, also find out what each open port speaks: plain, xfer-AE or TLS")
 	flagHelp    = flag.Bool("h", false, "show help")
 )
 
 // add info about the other flags too
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage:\n")
-	fmt.Fprintf(os.Stderr, "  Connect mode: %s [host:port]\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  Listen mode:  %s -l [-p port] [-k]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Connect mode: %s [-4|-6] [-source addr] [host[:port]|unix:/path|@name]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Listen mode:  %s -l [-b addr] [-4|-6] [-p port|unix:/path|@name] [-k] [-u] [-c [-max-conns n] [-policy p]]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Send a file:  %s send [-l] <file|dir> [host:port]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Receive:      %s recv [-l] [-o dir] [-f] [host:port]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Forward:      %s forward -L [host]:port [-in mode] [-out mode] host:port\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Reverse fwd:  %s -R [bind:]port:host:hostport -s -a key host:port   (server: %s -l -tunnel -s -a key)\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(os.Stderr, "  SOCKS proxy:  %s -D [bind:]port -s -a key host:port                 (server: %s -l -tunnel -s -a key)\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(os.Stderr, "                -tunnel requires -tls, or -s with -a key: it lets clients listen and connect from the server\n")
+	fmt.Fprintf(os.Stderr, "  Run command:  %s -e \"cmd args\" [-l] [host:port]   (peer: %s -E)\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Remote shell: %s -l -pty [-e cmd] -s -a key        (peer: %s -E -s -a key host:port)\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(os.Stderr, "                -l with -e or -pty requires -tls, or -s with -a key: whoever connects runs the command\n")
+	fmt.Fprintf(os.Stderr, "  From inetd:   %s -inetd -e \"cmd args\" -s -a key   (or systemd socket activation, LISTEN_FDS)\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Port scan:    %s -z [-probe [-a key]] host ports   (ports: 22,80,8000-8010)\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  Chat hub:     %s -l -hub [-label] [-s|-tls]\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nOptions:\n")
 	flag.PrintDefaults()
 }
 
+// parseArgs parses flags anywhere on the command line, not only before the
+// first positional argument, and returns the positional arguments.
+func parseArgs(args []string) []string {
+	var pos []string
+	for {
+		_ = flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			return pos
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
 func main() {
-	flag.Parse()
+	cmd := ""
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "send" || args[0] == "recv" || args[0] == "forward") {
+		cmd, args = args[0], args[1:]
+	}
+	pos := parseArgs(args)
 	if *flagHelp {
 		usage()
 		return
 	}
 
+	if *flagUDP && *flagTLS {
+		fmt.Fprintln(os.Stderr, "Error: -u cannot be combined with -tls (use -s for encrypted UDP)")
+		os.Exit(2)
+	}
+
 	if *flagTLS {
 		if *flagCert == "" {
 			fmt.Fprintln(os.Stderr, "Error: -cert is required when using -tls")
@@ -51,28 +132,409 @@ func main() {
 		}
 	}
 
+	if cmd == "forward" {
+		runForward(pos)
+		return
+	}
+	if *flagInetd {
+		*flagListen = true
+	}
+
+	opts := connection.Options{
+		Timeout:  *flagTimeout,
+		UDP:      *flagUDP,
+		Secure:   *flagSecure,
+		TLS:      *flagTLS,
+		Secret:   *flagAuth,
+		CertFile: *flagCert,
+		KeyFile:  *flagKey,
+		Digest:   *flagDigest,
+		Progress: *flagProg,
+		Compress: *flagComp,
+		Proxy:    *flagProxy,
+		ProxyCmd: *flagProxyC,
+		Family:   family(),
+		Source:   *flagSource,
+		Retry:    retries(),
+
+		Idle:             *flagIdle,
+		ConnectTimeout:   *flagConnTO,
+		HandshakeTimeout: *flagHandTO,
+	}
+	if opts.Idle > 0 && opts.UDP {
+		fmt.Fprintln(os.Stderr, "Error: -idle needs a stream; over -u use -t")
+		os.Exit(2)
+	}
+	if opts.Retry != 0 && *flagListen {
+		fmt.Fprintln(os.Stderr, "Error: -retry and -retry-forever are for the client")
+		os.Exit(2)
+	}
+	if opts.Source != "" && (*flagListen || opts.ProxyCmd != "") {
+		fmt.Fprintln(os.Stderr, "Error: -source is for a client that connects itself, not with -l or -proxy-command")
+		os.Exit(2)
+	}
+	if opts.ProxyCmd != "" && (opts.Proxy != "" || opts.UDP || *flagListen) {
+		fmt.Fprintln(os.Stderr, "Error: -proxy-command only applies to outgoing TCP connections and replaces -proxy")
+		os.Exit(2)
+	}
+	if opts.Proxy != "" {
+		if _, err := client.ParseProxy(opts.Proxy); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if opts.UDP || *flagListen {
+			fmt.Fprintln(os.Stderr, "Error: -proxy only applies to outgoing TCP connections")
+			os.Exit(2)
+		}
+	}
+	if opts.Compress != "" {
+		if _, err := connection.CompressionAlgos(opts.Compress); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if opts.UDP {
+			fmt.Fprintln(os.Stderr, "Error: -C needs a reliable stream and cannot be used with -u")
+			os.Exit(2)
+		}
+	}
+	if opts.Digest != "" {
+		if _, err := connection.WrapWithDigest(nil, opts.Digest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if opts.UDP || cmd != "" {
+			fmt.Fprintln(os.Stderr, "Error: -digest only applies to the stdin/stdout stream over TCP")
+			os.Exit(2)
+		}
+	}
+	if *flagScan {
+		runScan(cmd, pos, opts)
+		return
+	}
+
+	var handler connection.Handler = connection.HandleConn
+	if opts.UDP {
+		handler = connection.HandleDatagramConn
+	}
+	switch cmd {
+	case "send":
+		if len(pos) == 0 {
+			fmt.Fprintln(os.Stderr, "Error: send needs a file to send")
+			os.Exit(2)
+		}
+		path := pos[0]
+		pos = pos[1:]
+		handler = func(c net.Conn) error { return transfer.Send(c, path) }
+	case "recv":
+		dir := *flagOut
+		handler = func(c net.Conn) error { return transfer.Receive(c, dir, *flagForce) }
+	}
+	if *flagPty && *flagExec == "" {
+		*flagExec = os.Getenv("SHELL")
+		if *flagExec == "" {
+			*flagExec = "/bin/sh"
+		}
+	}
+	if *flagExec != "" || *flagExecCli {
+		if *flagExec != "" && *flagExecCli {
+			fmt.Fprintln(os.Stderr, "Error: -e and -E are the two ends of a connection, use one of them")
+			os.Exit(2)
+		}
+		if cmd != "" || opts.UDP || *flagHub {
+			fmt.Fprintln(os.Stderr, "Error: -e and -E need a TCP stream and cannot be combined with send, recv, -u or -hub")
+			os.Exit(2)
+		}
+		if *flagListen && *flagExec != "" && !opts.TLS && (!opts.Secure || opts.Secret == "") && !*flagInsExec {
+			// anyone who can connect would get the command, usually a shell
+			fmt.Fprintln(os.Stderr, "Error: -l with -e or -pty needs authenticated clients: use -tls, or -s with -a key (or -insecure-exec)")
+			os.Exit(2)
+		}
+		switch {
+		case *flagPty:
+			handler = connection.PtyHandler(*flagExec)
+		case *flagExec != "":
+			handler = connection.ExecHandler(*flagExec, *flagMerge)
+		default:
+			handler = connection.HandleExecClient
+		}
+	}
+	if *flagRemote != "" || *flagDynamic != "" || *flagTunnel {
+		if (*flagRemote != "" || *flagDynamic != "") && *flagListen || *flagTunnel && !*flagListen {
+			fmt.Fprintln(os.Stderr, "Error: -R and -D are for the client and -tunnel for the server (-l)")
+			os.Exit(2)
+		}
+		if *flagRemote != "" && *flagDynamic != "" {
+			fmt.Fprintln(os.Stderr, "Error: use either -R or -D")
+			os.Exit(2)
+		}
+		if cmd != "" || opts.UDP || *flagHub || *flagExec != "" || *flagExecCli || opts.Digest != "" {
+			fmt.Fprintln(os.Stderr, "Error: -R, -D and -tunnel need a TCP stream and cannot be combined with send, recv, -u, -hub, -e, -E or -digest")
+			os.Exit(2)
+		}
+		if *flagTunnel && !opts.TLS && (!opts.Secure || opts.Secret == "") {
+			// anyone who can connect could listen and dial through us
+			fmt.Fprintln(os.Stderr, "Error: -tunnel needs authenticated clients: use -tls, or -s with -a key")
+			os.Exit(2)
+		}
+		switch {
+		case *flagTunnel:
+			handler = forward.TunnelHandler(*flagTunLoc)
+			*flagConc = true
+		case *flagDynamic != "":
+			handler = forward.DynamicHandler(*flagDynamic)
+		default:
+			listen, target, err := forward.ParseRemoteSpec(*flagRemote)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(2)
+			}
+			handler = forward.ReverseHandler(listen, target, opts)
+		}
+	}
+	if cmd != "" && opts.UDP {
+		fmt.Fprintf(os.Stderr, "Error: %s needs a reliable stream and cannot be used with -u\n", cmd)
+		os.Exit(2)
+	}
+
+	if *flagHub {
+		if cmd != "" {
+			fmt.Fprintf(os.Stderr, "Error: -hub cannot be combined with %s\n", cmd)
+			os.Exit(2)
+		}
+		*flagConc = true
+	}
+	if *flagConc {
+		if !*flagListen || opts.UDP {
+			fmt.Fprintln(os.Stderr, "Error: -c only applies to a TCP server (-l without -u)")
+			os.Exit(2)
+		}
+		if *flagHub {
+			handler = server.NewHub(*flagLabel).Handle
+		} else if cmd == "" && *flagExec == "" && !*flagExecCli && !*flagTunnel {
+			mux, err := server.NewStdioMux(*flagPolicy, *flagOut)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(2)
+			}
+			handler = mux.Handle
+		}
+	}
+
+	if *flagInetd {
+		// stdin and stdout are the connection, not data to pump
+		usesStdio := cmd == "" && *flagExec == "" && !*flagTunnel
+		if usesStdio || opts.UDP {
+			fmt.Fprintln(os.Stderr, "Error: -inetd needs a handler that leaves stdin/stdout alone: send, recv, -e, -pty or -tunnel")
+			os.Exit(2)
+		}
+	}
+
+	if len(pos) > 0 && connection.IsUnixAddr(pos[0]) {
+		if opts.UDP || opts.Proxy != "" || opts.ProxyCmd != "" || opts.Family != 0 || opts.Source != "" || *flagBind != "" {
+			fmt.Fprintln(os.Stderr, "Error: -u, -proxy, -proxy-command, -4, -6, -source and -b do not apply to Unix sockets")
+			os.Exit(2)
+		}
+	}
+
 	// setup interrupt handling so we close cleanly
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigc
+		// -E may have put the terminal in raw mode
+		connection.RestoreTerminal()
 		os.Exit(0)
 	}()
 
 	if *flagListen {
-		addr := fmt.Sprintf(":%d", *flagPort)
-		server.RunServer(addr, *flagKeep, *flagTimeout, *flagSecure, *flagTLS, *flagAuth, *flagCert, *flagKey)
+		ln, conn, err := server.Activated()
+		if err == nil && *flagInetd {
+			ln, conn, err = server.Inetd()
+		}
+		if err == nil && opts.UDP && (ln != nil || conn != nil) {
+			err = fmt.Errorf("-u cannot serve a socket passed in by the service manager")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		switch {
+		case conn != nil:
+			server.ServeConn(conn, opts, handler)
+			return
+		case ln != nil:
+			fmt.Fprintf(os.Stderr, "listening on %s (inherited)\n", server.ListenAddr(ln))
+			if *flagConc {
+				server.ServeConcurrent(ln, *flagMaxConn, opts, handler)
+			} else {
+				server.Serve(ln, *flagKeep, opts, handler)
+			}
+			return
+		}
+
+		addr := net.JoinHostPort(*flagBind, strconv.Itoa(*flagPort))
+		switch {
+		case len(pos) > 0 && connection.IsUnixAddr(pos[0]):
+			addr = pos[0]
+		case connection.IsUnixAddr(*flagBind):
+			addr = *flagBind
+		}
+		if *flagConc {
+			server.RunConcurrentServer(addr, *flagMaxConn, opts, handler)
+			return
+		}
+		server.RunServer(addr, *flagKeep, opts, handler)
 		return
 	}
 
 	// client mode: need host:port argument
 	target := ""
-	if flag.NArg() > 0 {
-		target = flag.Arg(0)
+	if len(pos) > 0 {
+		target = pos[0]
+		if _, _, err := net.SplitHostPort(target); err != nil && !connection.IsUnixAddr(target) {
+			// a bare host connects to -p
+			target = net.JoinHostPort(strings.Trim(target, "[]"), strconv.Itoa(*flagPort))
+		}
 	} else {
 		// if no host:port provided, use localhost:port
-		target = fmt.Sprintf("127.0.0.1:%d", *flagPort)
+		loopback := "127.0.0.1"
+		if opts.Family == 6 {
+			loopback = "::1"
+		}
+		target = net.JoinHostPort(loopback, strconv.Itoa(*flagPort))
+	}
+
+	client.RunClient(target, opts, handler)
+}
+
+// runForward accepts connections on -L and relays each one to the target,
+// with -in and -out selecting the transport of the two legs.
+func runForward(pos []string) {
+	if *flagLocal == "" || len(pos) != 1 {
+		fmt.Fprintln(os.Stderr, "Error: forward needs -L [host]:port and a target host:port")
+		os.Exit(2)
+	}
+	if *flagSecure || *flagTLS || *flagUDP || *flagDigest != "" || *flagComp != "" || *flagExec != "" || *flagHub {
+		fmt.Fprintln(os.Stderr, "Error: forward only relays TCP; pick each leg's transport with -in and -out")
+		os.Exit(2)
+	}
+
+	base := connection.Options{
+		Timeout:  *flagTimeout,
+		Secret:   *flagAuth,
+		CertFile: *flagCert,
+		KeyFile:  *flagKey,
+		Progress: *flagProg,
+		Proxy:    *flagProxy,
+		ProxyCmd: *flagProxyC,
+		Family:   family(),
+		Source:   *flagSource,
+		Retry:    retries(),
+
+		Idle:             *flagIdle,
+		ConnectTimeout:   *flagConnTO,
+		HandshakeTimeout: *flagHandTO,
+	}
+	if base.ProxyCmd != "" && base.Source != "" {
+		fmt.Fprintln(os.Stderr, "Error: -source does not apply to -proxy-command")
+		os.Exit(2)
+	}
+	if base.ProxyCmd != "" && base.Proxy != "" {
+		fmt.Fprintln(os.Stderr, "Error: -proxy-command replaces -proxy")
+		os.Exit(2)
+	}
+	if base.Proxy != "" {
+		if _, err := client.ParseProxy(base.Proxy); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	inOpts, err := forward.LegOptions(base, *flagIn)
+	if err == nil && inOpts.TLS && (*flagCert == "" || *flagKey == "") {
+		err = fmt.Errorf("-in tls needs -cert and -key")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	outOpts, err := forward.LegOptions(base, *flagOutTr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	// one progress display per connection is enough
+	inOpts.Progress = false
+
+	server.RunConcurrentServer(*flagLocal, *flagMaxConn, inOpts, forward.Handler(pos[0], outOpts))
+}
+
+// runScan reports which ports of a host accept connections: open ones on
+// stdout, the rest on stderr. It exits 0 only if all of them are open.
+func runScan(cmd string, pos []string, opts connection.Options) {
+	if cmd != "" || *flagListen || opts.UDP || opts.ProxyCmd != "" || *flagExec != "" || *flagExecCli || *flagHub {
+		fmt.Fprintln(os.Stderr, "Error: -z connects to TCP ports itself and takes no other mode")
+		os.Exit(2)
+	}
+	var host, spec string
+	switch len(pos) {
+	case 1:
+		var err error
+		if host, spec, err = net.SplitHostPort(pos[0]); err != nil {
+			host, spec = pos[0], strconv.Itoa(*flagPort)
+		}
+	case 2:
+		host, spec = pos[0], pos[1]
+	default:
+		fmt.Fprintln(os.Stderr, "Error: -z needs a host and a port list, e.g. host 22,80,8000-8010")
+		os.Exit(2)
+	}
+	ports, err := scan.ParsePorts(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
 	}
 
-	client.RunClient(target, *flagTimeout, *flagSecure, *flagTLS, *flagAuth, *flagCert)
+	open := 0
+	for _, r := range scan.Scan(strings.Trim(host, "[]"), ports, opts, *flagProbe) {
+		addr := net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(r.Port))
+		if !r.Open() {
+			fmt.Fprintf(os.Stderr, "%s closed: %v\n", addr, r.Err)
+			continue
+		}
+		open++
+		line := addr + " open"
+		if r.Speaks != "" {
+			line += " " + r.Speaks
+		}
+		if r.Detail != "" {
+			line += " (" + r.Detail + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d ports open\n", open, len(ports))
+	if open < len(ports) {
+		os.Exit(1)
+	}
+}
+
+// family returns the IP version selected with -4 or -6, 0 for either.
+func family() int {
+	switch {
+	case *flagIPv4 && *flagIPv6:
+		fmt.Fprintln(os.Stderr, "Error: use either -4 or -6")
+		os.Exit(2)
+	case *flagIPv4:
+		return 4
+	case *flagIPv6:
+		return 6
+	}
+	return 0
+}
+
+// retries returns the -retry count, -1 with -retry-forever.
+func retries() int {
+	if *flagRetryF {
+		return -1
+	}
+	return max(*flagRetry, 0)
 }
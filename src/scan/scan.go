@@ -0,0 +1,187 @@
+// Package scan checks which TCP ports of a host accept connections and,
+// optionally, which transport each open port speaks.
+package scan
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jnsoft/xfer/src/client"
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// What an open port speaks, as found by Scan with probe set.
+const (
+	SpeaksPlain = "plain"
+	SpeaksAE    = "xfer-AE"
+	SpeaksTLS   = "TLS"
+)
+
+// defaultTimeout is the connect and handshake limit in seconds when opts
+// does not set one: a scan should not wait for the system's TCP timeout.
+const defaultTimeout = 3
+
+// maxParallel bounds the connections a scan has in flight.
+const maxParallel = 64
+
+// Result is the outcome for one port.
+type Result struct {
+	Port   int
+	Err    error  // why the port counts as closed; nil if open
+	Speaks string // with probe: SpeaksPlain, SpeaksAE or SpeaksTLS
+	Detail string // e.g. the certificate subject, or that our key was rejected
+}
+
+// Open reports whether the port accepted a connection.
+func (r Result) Open() bool { return r.Err == nil }
+
+// ParsePorts parses a port list such as "22,80,8000-8010".
+func ParsePorts(spec string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := parsePort(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parsePort(hi); err != nil {
+				return nil, err
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid port range %q", part)
+			}
+		}
+		for p := first; p <= last; p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// Scan connects to every port of host in parallel and returns the results
+// in port order. The connections are made as opts says (-4/-6, -source,
+// -proxy), but without a transport. With probe, every open port is asked
+// for an AE handshake (authenticated if opts.Secret is set) and then a TLS
+// one, each on a fresh connection. Either probe writes to the service, so
+// a plain xfer listener prints the attempt.
+func Scan(host string, ports []int, opts connection.Options, probe bool) []Result {
+	opts = plainOptions(opts)
+	results := make([]Result, len(ports))
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = scanPort(net.JoinHostPort(host, strconv.Itoa(port)), opts, probe)
+			results[i].Port = port
+		}()
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Port < results[j].Port })
+	return results
+}
+
+// plainOptions keeps what opts says about reaching the host and drops the
+// transport and stream layers, which the probes set up themselves.
+func plainOptions(opts connection.Options) connection.Options {
+	p := connection.Options{
+		Secret:           opts.Secret,
+		Proxy:            opts.Proxy,
+		Family:           opts.Family,
+		Source:           opts.Source,
+		ConnectTimeout:   opts.ConnectTimeout,
+		HandshakeTimeout: opts.HandshakeTimeout,
+	}
+	if p.ConnectTimeout <= 0 {
+		p.ConnectTimeout = defaultTimeout
+	}
+	if p.HandshakeTimeout <= 0 {
+		p.HandshakeTimeout = defaultTimeout
+	}
+	return p
+}
+
+func scanPort(addr string, opts connection.Options, probe bool) Result {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		return Result{Err: err}
+	}
+	_ = conn.Close()
+	if !probe {
+		return Result{}
+	}
+
+	if detail, err := probeAE(addr, opts); err == nil || errors.Is(err, connection.ErrAuthFailed) {
+		return Result{Speaks: SpeaksAE, Detail: detail}
+	}
+	if subject, err := probeTLS(addr, opts); err == nil {
+		return Result{Speaks: SpeaksTLS, Detail: subject}
+	}
+	return Result{Speaks: SpeaksPlain}
+}
+
+// probeAE tries the client side of the AE handshake on addr.
+func probeAE(addr string, opts connection.Options) (string, error) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_, err = connection.Handshake(conn, opts.HandshakeTimeout, func() (net.Conn, error) {
+		return connection.WrapWithAE(conn, false, opts.Secret)
+	})
+	switch {
+	case errors.Is(err, connection.ErrAuthFailed):
+		return "key rejected", err
+	case err != nil:
+		return "", err
+	case opts.Secret != "":
+		return "key accepted", nil
+	}
+	return "", nil
+}
+
+// probeTLS tries a TLS handshake on addr and returns the subject of the
+// certificate the server presents.
+func probeTLS(addr string, opts connection.Options) (string, error) {
+	conn, err := client.Dial(addr, opts)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true}) // we only look
+	_, err = connection.Handshake(conn, opts.HandshakeTimeout, func() (net.Conn, error) {
+		return tlsConn, tlsConn.Handshake()
+	})
+	if err != nil {
+		return "", err
+	}
+	state := tlsConn.ConnectionState()
+	subject := tls.VersionName(state.Version)
+	if len(state.PeerCertificates) > 0 {
+		subject += ", " + state.PeerCertificates[0].Subject.String()
+	}
+	return subject, nil
+}
@@ -0,0 +1,148 @@
+package scan
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+func TestParsePorts(t *testing.T) {
+	got, err := ParsePorts("22, 80,8000-8002,80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{22, 80, 8000, 8001, 8002}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParsePorts = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"", "0", "65536", "80-22", "http", "1-"} {
+		if _, err := ParsePorts(bad); err == nil {
+			t.Errorf("ParsePorts(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestScan_ProbeAE(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = connection.WrapWithAE(c, true, "key")
+			}()
+		}
+	}()
+	open := ln.Addr().(*net.TCPAddr).Port
+
+	// a port that was just free is most likely still closed
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := free.Addr().(*net.TCPAddr).Port
+	_ = free.Close()
+
+	results := Scan("127.0.0.1", []int{closed, open}, connection.Options{Secret: "key"}, true)
+	byPort := map[int]Result{results[0].Port: results[0], results[1].Port: results[1]}
+	if r := byPort[closed]; r.Open() {
+		t.Errorf("port %d reported open", closed)
+	}
+	r := byPort[open]
+	if !r.Open() || r.Speaks != SpeaksAE || r.Detail != "key accepted" {
+		t.Errorf("port %d: %+v, want open xfer-AE with the key accepted", open, r)
+	}
+}
+
+// serve runs handle for every connection to a new loopback listener and
+// returns its port.
+func serve(t *testing.T, handle func(net.Conn)) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "scan test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestScan_Probes(t *testing.T) {
+	cfg := &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	tlsPort := serve(t, func(c net.Conn) { _ = tls.Server(c, cfg).Handshake() })
+	aePort := serve(t, func(c net.Conn) { _, _ = connection.WrapWithAE(c, true, "key") })
+	plainPort := serve(t, func(c net.Conn) {
+		// a service that talks first, like ssh
+		_, _ = io.WriteString(c, "SSH-2.0-test\r\n")
+	})
+	// sends our handshake back, key and MAC included
+	echoPort := serve(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+
+	opts := connection.Options{Secret: "wrong", HandshakeTimeout: 2}
+	results := Scan("127.0.0.1", []int{tlsPort, aePort, plainPort, echoPort}, opts, true)
+	byPort := make(map[int]Result)
+	for _, r := range results {
+		byPort[r.Port] = r
+	}
+
+	if r := byPort[tlsPort]; r.Speaks != SpeaksTLS || !strings.HasPrefix(r.Detail, "TLS 1.3, ") || !strings.Contains(r.Detail, "CN=scan test") {
+		t.Errorf("TLS port: %+v, want TLS with version and subject", r)
+	}
+	if r := byPort[aePort]; r.Speaks != SpeaksAE || r.Detail != "key rejected" {
+		t.Errorf("AE port: %+v, want xfer-AE with our key rejected", r)
+	}
+	if r := byPort[plainPort]; !r.Open() || r.Speaks != SpeaksPlain {
+		t.Errorf("plain port: %+v, want open and plain", r)
+	}
+	if r := byPort[echoPort]; !r.Open() || r.Speaks != SpeaksPlain {
+		t.Errorf("echo port: %+v, want open and plain", r)
+	}
+}
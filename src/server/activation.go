@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// listenFdsStart is the first descriptor systemd passes, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// Activated returns the socket the service manager passed in through
+// LISTEN_PID/LISTEN_FDS: a listener for an Accept=no socket unit, or the
+// connection itself for an Accept=yes one. Both are nil when the process
+// was not socket activated. The variables are removed from the
+// environment so commands started with -e do not take them for their own.
+func Activated() (net.Listener, net.Conn, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, nil, fmt.Errorf("socket activation: invalid LISTEN_FDS %q", fds)
+	}
+	if n > 1 {
+		return nil, nil, fmt.Errorf("socket activation: got %d sockets, want one", n)
+	}
+	f := os.NewFile(listenFdsStart, "LISTEN_FDS")
+	defer f.Close() // FileConn and FileListener work on a dup
+	ln, conn, err := fileSocket(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return ln, conn, nil
+}
+
+// Inetd returns the socket inetd passes as stdin and stdout: the
+// connection in nowait mode, the listener in wait mode. When stdin is not
+// a socket, e.g. under socat or as the command of an ssh login, the
+// stdin/stdout pair itself is the connection. Either way stdin and stdout
+// are taken from then on: os.Stdin reads nothing and os.Stdout writes to
+// stderr, or nowhere if stderr is the socket as well.
+func Inetd() (net.Listener, net.Conn, error) {
+	var ln net.Listener
+	var conn net.Conn
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// only for a socket: FileConn makes the descriptor non-blocking
+		if ln, conn, err = fileSocket(os.Stdin); err != nil {
+			return nil, nil, fmt.Errorf("inetd: %w", err)
+		}
+	} else {
+		conn = connection.RWConn(&stdioPipe{r: os.Stdin, w: os.Stdout}, "stdio")
+	}
+
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		} else {
+			_ = ln.Close()
+		}
+		return nil, nil, err
+	}
+	os.Stdin, os.Stdout = null, os.Stderr
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// classic inetd hands the socket over as stderr too
+		os.Stdout, os.Stderr = null, null
+	}
+	return ln, conn, nil
+}
+
+// fileSocket turns an inherited socket into a listener or a connection,
+// depending on whether it is listening.
+func fileSocket(f *os.File) (net.Listener, net.Conn, error) {
+	if isListener(f) {
+		ln, err := net.FileListener(f)
+		return ln, nil, err
+	}
+	conn, err := net.FileConn(f)
+	return nil, conn, err
+}
+
+// stdioPipe is a stdin/stdout pair as an io.ReadWriteCloser.
+type stdioPipe struct {
+	r, w *os.File
+}
+
+func (p *stdioPipe) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *stdioPipe) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+// CloseWrite closes stdout, which is how the peer sees our half-close.
+func (p *stdioPipe) CloseWrite() error { return p.w.Close() }
+
+func (p *stdioPipe) Close() error {
+	return errors.Join(p.r.Close(), p.w.Close())
+}
+
+// ServeConn serves a single connection the server did not accept itself,
+// one passed in by inetd or socket activation, and exits non-zero if that
+// fails.
+func ServeConn(conn net.Conn, opts connection.Options, handler connection.Handler) {
+	fmt.Fprintf(os.Stderr, "connection from %s\n", peerInfo(conn))
+	useConn, err := WrapConn(conn, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		_ = conn.Close()
+		os.Exit(2)
+	}
+
+	connection.ApplyTimeout(useConn, opts.Timeout)
+	err = handler(useConn)
+	_ = useConn.Close()
+	fmt.Fprintf(os.Stderr, "connection closed %s\n", peerName(conn))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(connection.ExitCode(err))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// isListener reports false: inherited sockets are a unix thing.
+func isListener(f *os.File) bool { return false }
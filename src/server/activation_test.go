@@ -0,0 +1,188 @@
+//go:build unix
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// activatedChild is set in the copy of the test binary that
+// TestActivated_* start with a socket on fd 3.
+const activatedChild = "XFER_TEST_ACTIVATED"
+
+// TestActivatedHelper is the child side: it plays the service, reports what
+// Activated returned on stdout and greets through the socket.
+func TestActivatedHelper(t *testing.T) {
+	if os.Getenv(activatedChild) == "" {
+		t.Skip("only run as a child of TestActivated_*")
+	}
+	// the service manager sets this to the pid it started
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	ln, conn, err := Activated()
+	if err != nil {
+		fmt.Printf("error %v\n", err)
+		return
+	}
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		fmt.Println("environment not cleared")
+		return
+	}
+	switch {
+	case ln != nil:
+		fmt.Printf("listener %s\n", ln.Addr())
+		if c, err := ln.Accept(); err == nil {
+			_, _ = io.WriteString(c, "hello")
+			_ = c.Close()
+		}
+	case conn != nil:
+		fmt.Println("conn")
+		_, _ = io.WriteString(conn, "hello")
+		_ = conn.Close()
+	default:
+		fmt.Println("nothing")
+	}
+}
+
+// runActivated starts TestActivatedHelper with f as fd 3 and returns the
+// kind of socket it got once it is running.
+func runActivated(t *testing.T, f *os.File) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivatedHelper$")
+	cmd.Env = append(os.Environ(), activatedChild+"=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatalf("child said nothing: %v", err)
+	}
+	kind, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	return kind
+}
+
+func TestActivated_Listener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if kind := runActivated(t, f); kind != "listener" {
+		t.Fatalf("child got a %q, want the listener", kind)
+	}
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if b, _ := io.ReadAll(c); string(b) != "hello" {
+		t.Fatalf("got %q from the child", b)
+	}
+}
+
+func TestActivated_Conn(t *testing.T) {
+	ours, theirs := socketPair(t)
+	defer ours.Close()
+
+	kind := runActivated(t, theirs)
+	_ = theirs.Close()
+	if kind != "conn" {
+		t.Fatalf("child got %q, want the connection", kind)
+	}
+	if b, _ := io.ReadAll(ours); string(b) != "hello" {
+		t.Fatalf("got %q from the child", b)
+	}
+}
+
+func TestActivated_OtherPid(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	ln, conn, err := Activated()
+	if ln != nil || conn != nil || err != nil {
+		t.Fatalf("Activated = %v, %v, %v; want nothing for another process", ln, conn, err)
+	}
+}
+
+func TestInetd_SocketOnStdin(t *testing.T) {
+	ours, theirs := socketPair(t)
+	defer ours.Close()
+	defer theirs.Close()
+
+	origIn, origOut, origErr := os.Stdin, os.Stdout, os.Stderr
+	defer func() { os.Stdin, os.Stdout, os.Stderr = origIn, origOut, origErr }()
+	os.Stdin, os.Stdout = theirs, theirs
+
+	ln, conn, err := Inetd()
+	if err != nil || ln != nil || conn == nil {
+		t.Fatalf("Inetd = %v, %v, %v; want the connection", ln, conn, err)
+	}
+	defer conn.Close()
+	if os.Stdin == theirs || os.Stdout == theirs {
+		t.Error("stdin/stdout still refer to the socket")
+	}
+
+	go func() { _, _ = conn.Write([]byte("hello")) }()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ours, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestInetd_ListenerOnStdin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	origIn, origOut, origErr := os.Stdin, os.Stdout, os.Stderr
+	defer func() { os.Stdin, os.Stdout, os.Stderr = origIn, origOut, origErr }()
+	os.Stdin = f
+
+	ln, conn, err := Inetd()
+	if err != nil || conn != nil || ln == nil {
+		t.Fatalf("Inetd = %v, %v, %v; want the listener (wait mode)", ln, conn, err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != l.Addr().String() {
+		t.Fatalf("listener on %s, want %s", ln.Addr(), l.Addr())
+	}
+}
+
+// socketPair returns both ends of a connected Unix stream socket pair.
+func socketPair(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.NewFile(uintptr(fds[0]), "ours"), os.NewFile(uintptr(fds[1]), "theirs")
+}
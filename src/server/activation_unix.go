@@ -0,0 +1,23 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// isListener reports whether f is a listening socket rather than a
+// connected one.
+func isListener(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var v int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	})
+	return err == nil && serr == nil && v != 0
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// RunConcurrentServer listens on addr and serves every accepted connection in
+// its own goroutine, so one slow client does not hold up the others. When
+// maxConns > 0, connections beyond that many active ones are closed right
+// after accept. Log lines are tagged with a connection number and address.
+func RunConcurrentServer(addr string, maxConns int, opts connection.Options, handler connection.Handler) {
+	ln, err := connection.Listen(addr, opts.Family)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen error: %v\n", err)
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stderr, "listening on %s (concurrent)\n", ListenAddr(ln))
+	ServeConcurrent(ln, maxConns, opts, handler)
+}
+
+// ServeConcurrent runs RunConcurrentServer's accept loop on ln and closes
+// ln when done.
+func ServeConcurrent(ln net.Listener, maxConns int, opts connection.Options, handler connection.Handler) {
+	defer ln.Close()
+	var active atomic.Int64
+	for id := 1; ; id++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "accept error: %v\n", err)
+			// e.g. out of file descriptors: back off instead of spinning
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		tag := fmt.Sprintf("[#%d %s] ", id, peerName(conn))
+		if maxConns > 0 && active.Load() >= int64(maxConns) {
+			fmt.Fprintf(os.Stderr, "%srejected: %d connections already active\n", tag, maxConns)
+			_ = conn.Close()
+			continue
+		}
+		active.Add(1)
+		fmt.Fprintf(os.Stderr, "%sconnection from %s\n", tag, peerInfo(conn))
+
+		go func() {
+			defer active.Add(-1)
+			serveConn(conn, tag, opts, handler)
+		}()
+	}
+}
+
+// serveConn wraps one accepted connection, runs handler on it and closes it.
+func serveConn(conn net.Conn, tag string, opts connection.Options, handler connection.Handler) {
+	useConn, err := WrapConn(conn, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v\n", tag, err)
+		_ = conn.Close()
+		return
+	}
+
+	connection.ApplyTimeout(useConn, opts.Timeout)
+	err = handler(useConn)
+	_ = useConn.Close()
+	fmt.Fprintf(os.Stderr, "%sconnection closed\n", tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%serror: %v\n", tag, err)
+	}
+}
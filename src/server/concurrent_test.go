@@ -0,0 +1,104 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// serveConcurrent runs ServeConcurrent with handler on a loopback listener
+// and returns its address.
+func serveConcurrent(t *testing.T, maxConns int, handler connection.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeConcurrent(ln, maxConns, connection.Options{}, handler)
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln.Addr().String()
+}
+
+// greet dials addr and returns what the server sent before closing the
+// connection.
+func greet(t *testing.T, addr string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, _ := io.ReadAll(c)
+	return string(b)
+}
+
+func TestServeConcurrent_ServesInParallel(t *testing.T) {
+	// every handler waits for the other one, which only works if both run
+	// at the same time
+	var arrived atomic.Int32
+	both := make(chan struct{})
+	addr := serveConcurrent(t, 0, func(conn net.Conn) error {
+		if arrived.Add(1) == 2 {
+			close(both)
+		}
+		select {
+		case <-both:
+			_, err := io.WriteString(conn, "ok")
+			return err
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+
+	got := make(chan string, 2)
+	for range 2 {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		go func() {
+			b, _ := io.ReadAll(c)
+			got <- string(b)
+		}()
+	}
+	for range 2 {
+		if g := <-got; g != "ok" {
+			t.Fatalf("client got %q, want both served together", g)
+		}
+	}
+}
+
+func TestServeConcurrent_MaxConns(t *testing.T) {
+	release := make(chan struct{})
+	addr := serveConcurrent(t, 1, func(conn net.Conn) error {
+		_, _ = io.WriteString(conn, "served")
+		<-release
+		return nil
+	})
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := io.ReadFull(first, make([]byte, len("served"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is reached: closed right after accept, handler not run
+	if g := greet(t, addr); g != "" {
+		t.Fatalf("second client got %q, want it rejected", g)
+	}
+
+	// once the first is done its slot is free again
+	close(release)
+	_ = first.Close()
+	waitFor(t, "a free slot", func() bool { return greet(t, addr) == "served" })
+}
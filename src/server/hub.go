@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// a member whose queue fills up is too slow to keep up and is dropped
+const hubQueueLen = 256
+
+// hubMaxLine caps a labelled line: a longer one is relayed in pieces of this
+// size, so a sender that never ends a line cannot make the hub buffer
+// without limit.
+const hubMaxLine = 64 * 1024
+
+// Hub relays everything one connection sends to all other connections, and
+// the server's stdin to all of them. Its Handle method is the Handler for
+// hub mode. With labels, traffic is relayed line by line, each line prefixed
+// with its sender.
+type Hub struct {
+	label bool
+	in    io.Reader
+	out   io.Writer
+
+	mu        sync.Mutex
+	members   map[net.Conn]*hubMember
+	startOnce sync.Once
+}
+
+type hubMember struct {
+	conn  net.Conn
+	queue chan []byte
+	gone  chan struct{}
+	once  sync.Once
+}
+
+// NewHub returns an empty hub. label prefixes relayed lines with the
+// sender's address.
+func NewHub(label bool) *Hub {
+	return &Hub{
+		label:   label,
+		in:      os.Stdin,
+		out:     lockedWriter{&sync.Mutex{}, os.Stdout},
+		members: make(map[net.Conn]*hubMember),
+	}
+}
+
+// Handle joins conn to the hub and relays what it sends until it leaves.
+func (h *Hub) Handle(conn net.Conn) error {
+	h.startOnce.Do(func() { go h.pumpStdin() })
+
+	m := &hubMember{conn: conn, queue: make(chan []byte, hubQueueLen), gone: make(chan struct{})}
+	go m.writeLoop()
+	name := conn.RemoteAddr().String()
+
+	h.mu.Lock()
+	h.members[conn] = m
+	h.mu.Unlock()
+	if h.label {
+		h.broadcast(m, fmt.Appendf(nil, "*** %s joined\n", name))
+	}
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.members, conn)
+		h.mu.Unlock()
+		m.leave()
+		if h.label {
+			h.broadcast(nil, fmt.Appendf(nil, "*** %s left\n", name))
+		}
+	}()
+	// a member that stops sending has left: a half-close cannot be told
+	// from a client that went away without writing to it, and one that went
+	// away must not hold its place until the next broadcast
+	err := h.relay(m, conn, name)
+	select {
+	case <-m.gone:
+		// dropped, the read failed because its conn was closed
+		return nil
+	default:
+		return err
+	}
+}
+
+// relay reads from r and broadcasts it as coming from m.
+func (h *Hub) relay(m *hubMember, r io.Reader, name string) error {
+	if !h.label {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				h.broadcast(m, append([]byte(nil), buf[:n]...))
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	br := bufio.NewReaderSize(r, hubMaxLine)
+	prefix := "[" + name + "] "
+	for {
+		line, err := readLine(br)
+		if len(line) > 0 {
+			h.broadcast(m, append([]byte(prefix), line...))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// broadcast writes msg to the server's stdout and queues it for every
+// member except from.
+func (h *Hub) broadcast(from *hubMember, msg []byte) {
+	_, _ = h.out.Write(msg)
+	h.deliver(from, msg)
+}
+
+// deliver queues msg for every member except skip.
+func (h *Hub) deliver(skip *hubMember, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.members {
+		if m == skip {
+			continue
+		}
+		select {
+		case m.queue <- msg:
+		default:
+			fmt.Fprintf(os.Stderr, "dropping %s: too slow to keep up\n", m.conn.RemoteAddr())
+			m.leave()
+			_ = m.conn.Close()
+		}
+	}
+}
+
+// pumpStdin sends the server's stdin to every member. It is not echoed to
+// the server's own stdout.
+func (h *Hub) pumpStdin() {
+	if !h.label {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := h.in.Read(buf)
+			if n > 0 {
+				h.deliver(nil, append([]byte(nil), buf[:n]...))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	br := bufio.NewReaderSize(h.in, hubMaxLine)
+	for {
+		line, err := readLine(br)
+		if len(line) > 0 {
+			h.deliver(nil, append([]byte("[server] "), line...))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readLine returns the next line of br, at most hubMaxLine bytes of it, as a
+// copy ending in a newline.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	if len(line) == 0 {
+		return nil, err
+	}
+	out := make([]byte, len(line), len(line)+1)
+	copy(out, line)
+	if out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return out, err
+}
+
+func (m *hubMember) writeLoop() {
+	for {
+		select {
+		case <-m.gone:
+			return
+		case msg := <-m.queue:
+			if _, err := m.conn.Write(msg); err != nil {
+				// ends the relay of what it sends as well
+				m.leave()
+				_ = m.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (m *hubMember) leave() {
+	m.once.Do(func() { close(m.gone) })
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestHub returns a hub that reads the returned pipe instead of stdin
+// and writes to out instead of stdout.
+func newTestHub(t *testing.T, label bool) (*Hub, *io.PipeWriter, *syncBuffer) {
+	t.Helper()
+	h := NewHub(label)
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { _ = pw.Close() })
+	out := &syncBuffer{}
+	h.in, h.out = pr, out
+	return h, pw, out
+}
+
+// join serves a new connection with h and returns the client end once it
+// is a member. The returned channel gets Handle's result.
+func join(t *testing.T, h *Hub) (net.Conn, <-chan error) {
+	t.Helper()
+	server, client := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(server)
+		_ = server.Close()
+	}()
+	waitFor(t, "the member to join", func() bool { return h.isMember(server) })
+	return client, done
+}
+
+func (h *Hub) isMember(conn net.Conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.members[conn]
+	return ok
+}
+
+func TestHub_Broadcast(t *testing.T) {
+	h, stdin, out := newTestHub(t, false)
+	a, _ := join(t, h)
+	b, _ := join(t, h)
+	c, _ := join(t, h)
+
+	_, _ = io.WriteString(a, "from a")
+	for _, m := range []net.Conn{b, c} {
+		if got := readN(t, m, 6); got != "from a" {
+			t.Errorf("member got %q", got)
+		}
+	}
+	waitFor(t, "the server's copy", func() bool { return out.String() == "from a" })
+
+	// stdin goes to everyone, the sender of the last message included
+	_, _ = io.WriteString(stdin, "server")
+	for _, m := range []net.Conn{a, b, c} {
+		if got := readN(t, m, 6); got != "server" {
+			t.Errorf("member got %q from stdin", got)
+		}
+	}
+	if out.String() != "from a" {
+		t.Errorf("stdin echoed to stdout: %q", out.String())
+	}
+}
+
+func TestHub_Labels(t *testing.T) {
+	h, stdin, _ := newTestHub(t, true)
+	a, _ := join(t, h)
+	b, bDone := join(t, h)
+	aName, bName := a.LocalAddr().String(), b.LocalAddr().String()
+
+	want := "*** " + bName + " joined\n"
+	if got := readN(t, a, len(want)); got != want {
+		t.Fatalf("got %q, want the join notice", got)
+	}
+	_, _ = io.WriteString(a, "hi\n")
+	want = "[" + aName + "] hi\n"
+	if got := readN(t, b, len(want)); got != want {
+		t.Fatalf("got %q, want the labelled line", got)
+	}
+	_, _ = io.WriteString(stdin, "all\n")
+	want = "[server] all\n"
+	for _, m := range []net.Conn{a, b} {
+		if got := readN(t, m, len(want)); got != want {
+			t.Fatalf("got %q, want the server's line", got)
+		}
+	}
+
+	_ = b.Close()
+	if err := <-bDone; err != nil {
+		t.Fatalf("Handle = %v", err)
+	}
+	want = "*** " + bName + " left\n"
+	if got := readN(t, a, len(want)); got != want {
+		t.Fatalf("got %q, want the leave notice", got)
+	}
+}
+
+func TestHub_HalfCloseLeaves(t *testing.T) {
+	h, _, _ := newTestHub(t, false)
+	a, aDone := join(t, h)
+
+	// done sending counts as gone: the place is not held until a write fails
+	_ = a.(*net.TCPConn).CloseWrite()
+	select {
+	case err := <-aDone:
+		if err != nil {
+			t.Fatalf("Handle = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("member that half-closed is still in the hub")
+	}
+}
+
+func TestHub_DropsSlowMember(t *testing.T) {
+	h, _, _ := newTestHub(t, false)
+	// nobody reads the other end, so the first write blocks and the queue
+	// fills up behind it
+	slow, peer := net.Pipe()
+	defer peer.Close()
+	slowDone := make(chan error, 1)
+	go func() { slowDone <- h.Handle(slow) }()
+	waitFor(t, "the slow member to join", func() bool { return h.isMember(slow) })
+	fast, _ := join(t, h)
+
+	// in step with the fast member, which must not fall behind itself
+	for range hubQueueLen + 2 {
+		h.deliver(nil, []byte("x"))
+		if got := readN(t, fast, 1); got != "x" {
+			t.Fatalf("fast member got %q", got)
+		}
+	}
+	select {
+	case err := <-slowDone:
+		if err != nil {
+			t.Fatalf("Handle of the dropped member = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow member was not dropped")
+	}
+	h.mu.Lock()
+	left := len(h.members)
+	h.mu.Unlock()
+	if left != 1 {
+		t.Fatalf("%d members left, want just the fast one", left)
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCred returns the process credentials of a Unix socket peer as taken
+// at connect time (SO_PEERCRED), or "" for other connections.
+func peerCred(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *syscall.Ucred
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cerr != nil {
+		return ""
+	}
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", cred.Pid, cred.Uid, cred.Gid)
+}
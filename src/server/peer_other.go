@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// peerCred returns "": SO_PEERCRED is Linux only.
+func peerCred(conn net.Conn) string { return "" }
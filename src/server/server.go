@@ -3,21 +3,37 @@ package server
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/jnsoft/xfer/src/connection"
 )
 
-func RunServer(addr string, keep bool, timeout int, secure, use_tls bool, secret, certFile, keyFile string) {
-	ln, err := net.Listen("tcp", addr)
+// RunServer listens on addr, wraps each accepted connection according to
+// opts and runs handler on it. Without keep it serves a single connection.
+func RunServer(addr string, keep bool, opts connection.Options, handler connection.Handler) {
+	if opts.UDP {
+		runUDPServer(addr, keep, opts)
+		return
+	}
+
+	ln, err := connection.Listen(addr, opts.Family)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "listen error: %v\n", err)
 		os.Exit(2)
 	}
-	defer ln.Close()
-	fmt.Fprintf(os.Stderr, "listening on %s\n", addr)
+	// the actual address, so a harness that passed port 0 can find us
+	fmt.Fprintf(os.Stderr, "listening on %s\n", ListenAddr(ln))
+	Serve(ln, keep, opts, handler)
+}
 
+// Serve runs RunServer's accept loop on ln, e.g. a listener passed in by
+// socket activation, and closes ln when done.
+func Serve(ln net.Listener, keep bool, opts connection.Options, handler connection.Handler) {
+	defer ln.Close()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -27,45 +43,209 @@ func RunServer(addr string, keep bool, timeout int, secure, use_tls bool, secret
 			}
 			break
 		}
-		fmt.Fprintf(os.Stderr, "connection from %s\n", conn.RemoteAddr())
+		fmt.Fprintf(os.Stderr, "connection from %s\n", peerInfo(conn))
 
-		var useConn net.Conn = conn
-		if use_tls {
-			// Load server certificate and key from files
-			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "TLS cert/key load error: %v\n", err)
-				_ = conn.Close()
+		useConn, err := WrapConn(conn, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			_ = conn.Close()
+			if keep {
 				continue
 			}
-			tlsConf := &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS13,
-			}
-			tlsConn := tls.Server(conn, tlsConf)
-			if err := tlsConn.Handshake(); err != nil {
-				fmt.Fprintf(os.Stderr, "TLS handshake error: %v\n", err)
-				_ = conn.Close()
-				continue
+			break
+		}
+
+		connection.ApplyTimeout(useConn, opts.Timeout)
+		err = handler(useConn)
+		_ = useConn.Close()
+		fmt.Fprintf(os.Stderr, "connection closed %s\n", peerName(conn))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			if !keep {
+				os.Exit(connection.ExitCode(err))
 			}
-			useConn = tlsConn
-		} else if secure {
-			secureConn, err := connection.WrapWithAE(conn, true, secret)
+		}
+
+		if !keep {
+			break
+		}
+	}
+}
+
+// WrapConn performs the server side of the TLS or AE handshake selected in
+// opts on an accepted connection, within opts.HandshakeTimeout, and adds
+// the optional stream layers.
+func WrapConn(conn net.Conn, opts connection.Options) (net.Conn, error) {
+	return connection.Handshake(conn, opts.HandshakeTimeout, func() (net.Conn, error) {
+		return wrapConn(conn, opts)
+	})
+}
+
+func wrapConn(conn net.Conn, opts connection.Options) (net.Conn, error) {
+	if opts.TLS {
+		// Load server certificate and key from files
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS cert/key load error: %w", err)
+		}
+		tlsConf := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+		}
+		tlsConn := tls.Server(conn, tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake error: %w", err)
+		}
+		return connection.WrapStream(tlsConn, opts)
+	}
+	if opts.Secure {
+		secureConn, err := connection.WrapWithAE(conn, true, opts.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("handshake error: %w", err)
+		}
+		return connection.WrapStream(secureConn, opts)
+	}
+	return connection.WrapStream(conn, opts)
+}
+
+// runUDPServer serves stdin/stdout over UDP. Without keep it locks onto the
+// first peer; with keep it tracks every peer that sends to it, writes all
+// incoming datagrams to stdout and sends each stdin read to every peer.
+// With opts.Secure every peer gets its own datagram AE session.
+func runUDPServer(addr string, keep bool, opts connection.Options) {
+	ln, err := connection.ListenUDP(connection.Network("udp", opts.Family), addr, keep)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen error: %v\n", err)
+		os.Exit(2)
+	}
+	defer ln.Close()
+	fmt.Fprintf(os.Stderr, "listening on %s (udp)\n", ListenAddr(ln))
+
+	if !keep {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "accept error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "datagram from %s\n", conn.RemoteAddr())
+		if opts.Secure {
+			secureConn, err := wrapDatagram(conn, opts)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "handshake error: %v\n", err)
-				_ = conn.Close()
-				if keep {
-					continue
-				}
-				break
+				return
 			}
-			useConn = secureConn
+			conn = secureConn
 		}
+		connection.ApplyTimeout(conn, opts.Timeout)
+		_ = connection.HandleDatagramConn(conn)
+		fmt.Fprintf(os.Stderr, "connection closed %s\n", conn.RemoteAddr())
+		return
+	}
 
-		connection.HandleConn(useConn, timeout)
+	var (
+		mu    sync.Mutex
+		peers = make(map[net.Conn]struct{})
+	)
 
-		if !keep {
-			break
+	// stdin -> every tracked peer
+	go func() {
+		buf := make([]byte, connection.MaxDatagram)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				mu.Lock()
+				for p := range peers {
+					_, _ = p.Write(buf[:n])
+				}
+				mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var outMu sync.Mutex
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "accept error: %v\n", err)
+			return
 		}
+		fmt.Fprintf(os.Stderr, "datagram from %s\n", conn.RemoteAddr())
+
+		// peer -> stdout, until the peer times out
+		go func(c net.Conn) {
+			if opts.Secure {
+				secureConn, err := wrapDatagram(c, opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "handshake error from %s: %v\n", c.RemoteAddr(), err)
+					_ = c.Close()
+					return
+				}
+				c = secureConn
+			}
+			connection.ApplyTimeout(c, opts.Timeout)
+
+			mu.Lock()
+			peers[c] = struct{}{}
+			mu.Unlock()
+
+			_ = connection.CopyDatagrams(lockedWriter{&outMu, os.Stdout}, c)
+			mu.Lock()
+			delete(peers, c)
+			mu.Unlock()
+			_ = c.Close()
+			fmt.Fprintf(os.Stderr, "peer gone %s\n", c.RemoteAddr())
+		}(conn)
+	}
+}
+
+// wrapDatagram performs the server side of the datagram AE handshake on a
+// UDP peer within opts.HandshakeTimeout.
+func wrapDatagram(conn net.Conn, opts connection.Options) (net.Conn, error) {
+	return connection.Handshake(conn, opts.HandshakeTimeout, func() (net.Conn, error) {
+		timeout := time.Duration(opts.HandshakeTimeout) * time.Second
+		return connection.WrapDatagramWithAE(conn, true, opts.Secret, timeout)
+	})
+}
+
+// lockedWriter serializes writes from several goroutines onto one writer.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// ListenAddr is how log lines name a listener: its bound address, with the
+// port the kernel picked, or unix:path for a Unix socket.
+func ListenAddr(ln interface{ Addr() net.Addr }) string {
+	a := ln.Addr()
+	if a.Network() == "unix" {
+		return "unix:" + a.String()
+	}
+	return a.String()
+}
+
+// peerName is how log lines refer to the other end of conn. Unix socket
+// clients usually have no name, so they go by the socket they came in on.
+func peerName(conn net.Conn) string {
+	if addr := conn.RemoteAddr().String(); addr != "" && addr != "@" {
+		return addr
+	}
+	return conn.LocalAddr().Network() + ":" + conn.LocalAddr().String()
+}
+
+// peerInfo is peerName plus the peer's credentials where the system has
+// them, for the line that announces a connection.
+func peerInfo(conn net.Conn) string {
+	if cred := peerCred(conn); cred != "" {
+		return peerName(conn) + " (" + cred + ")"
 	}
+	return peerName(conn)
 }
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jnsoft/xfer/src/connection"
+)
+
+// Policies for sharing the server's stdin and stdout between connections.
+const (
+	PolicyFirst = "first" // stdin goes to the oldest connection, all output to stdout
+	PolicyRR    = "rr"    // each stdin read goes to the next connection in turn, all output to stdout
+	PolicyFiles = "files" // stdin as for first, each connection's output to its own file
+)
+
+// StdioMux shares one stdin and stdout between concurrently served
+// connections. Its Handle method is the Handler for concurrent stdio mode.
+// Output from different connections is interleaved per read, never within
+// one.
+type StdioMux struct {
+	policy string
+	outDir string
+	in     io.Reader
+	out    io.Writer
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	conns     []net.Conn // active connections, oldest first
+	next      int        // round-robin cursor
+	seq       int        // numbers output files
+	stdinDone bool
+	startOnce sync.Once
+}
+
+// NewStdioMux returns a mux for policy. outDir is where PolicyFiles writes.
+func NewStdioMux(policy, outDir string) (*StdioMux, error) {
+	if !slices.Contains([]string{PolicyFirst, PolicyRR, PolicyFiles}, policy) {
+		return nil, fmt.Errorf("unknown policy %q (want first, rr or files)", policy)
+	}
+	m := &StdioMux{
+		policy: policy,
+		outDir: outDir,
+		in:     os.Stdin,
+		out:    lockedWriter{&sync.Mutex{}, os.Stdout},
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m, nil
+}
+
+// Handle copies conn's output to stdout or its file until the peer is done,
+// while stdin is fed to the connections by a shared reader.
+func (m *StdioMux) Handle(conn net.Conn) error {
+	m.startOnce.Do(func() { go m.pumpStdin() })
+
+	out := m.out
+	if m.policy == PolicyFiles {
+		f, err := m.createOutput(conn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+		fmt.Fprintf(os.Stderr, "writing output of %s to %s\n", conn.RemoteAddr(), f.Name())
+	}
+
+	m.add(conn)
+	defer m.remove(conn)
+	_, err := io.Copy(out, conn)
+	return err
+}
+
+func (m *StdioMux) createOutput(conn net.Conn) (*os.File, error) {
+	m.mu.Lock()
+	m.seq++
+	n := m.seq
+	m.mu.Unlock()
+	addr := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String())
+	name := filepath.Join(m.outDir, fmt.Sprintf("conn-%d-%s.out", n, addr))
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+func (m *StdioMux) add(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stdinDone {
+		_ = connection.CloseWrite(conn)
+	}
+	m.conns = append(m.conns, conn)
+	m.cond.Broadcast()
+}
+
+func (m *StdioMux) remove(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := slices.Index(m.conns, conn); i >= 0 {
+		m.conns = slices.Delete(m.conns, i, i+1)
+		if m.next > i {
+			m.next--
+		}
+	}
+}
+
+// pumpStdin reads stdin for as long as the server runs and hands every chunk
+// to one connection. A chunk read while no one is connected waits for the
+// next connection; one whose write fails is retried on another.
+func (m *StdioMux) pumpStdin() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := m.in.Read(buf)
+		if n > 0 {
+			m.dispatch(buf[:n])
+		}
+		if err != nil {
+			m.mu.Lock()
+			m.stdinDone = true
+			for _, c := range m.conns {
+				_ = connection.CloseWrite(c)
+			}
+			m.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (m *StdioMux) dispatch(chunk []byte) {
+	for {
+		m.mu.Lock()
+		for len(m.conns) == 0 {
+			m.cond.Wait()
+		}
+		target := m.conns[0]
+		if m.policy == PolicyRR {
+			target = m.conns[m.next%len(m.conns)]
+			m.next = (m.next + 1) % len(m.conns)
+		}
+		m.mu.Unlock()
+
+		if _, err := target.Write(chunk); err == nil {
+			return
+		}
+		m.remove(target)
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the server and client ends of a loopback TCP connection,
+// which unlike net.Pipe can half-close.
+func tcpPair(t *testing.T) (server, client net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return server, client
+}
+
+// syncBuffer is a bytes.Buffer that Handle goroutines can share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestMux returns a mux for policy that reads the returned pipe instead
+// of stdin and writes to out instead of stdout.
+func newTestMux(t *testing.T, policy, outDir string) (*StdioMux, *io.PipeWriter, *syncBuffer) {
+	t.Helper()
+	m, err := NewStdioMux(policy, outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { _ = pw.Close() })
+	out := &syncBuffer{}
+	m.in, m.out = pr, out
+	return m, pw, out
+}
+
+// attach serves a new connection with m and returns the client end once
+// the mux has it, so the connections are ordered as attached.
+func attach(t *testing.T, m *StdioMux, done *sync.WaitGroup) net.Conn {
+	t.Helper()
+	server, client := tcpPair(t)
+	m.mu.Lock()
+	n := len(m.conns)
+	m.mu.Unlock()
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		_ = m.Handle(server)
+	}()
+	waitFor(t, "the mux to take the connection", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.conns) > n
+	})
+	return client
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// readN reads exactly n bytes from c.
+func readN(t *testing.T, c net.Conn, n int) string {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf)
+}
+
+func TestStdioMux_First(t *testing.T) {
+	m, stdin, out := newTestMux(t, PolicyFirst, "")
+	var done sync.WaitGroup
+	a := attach(t, m, &done)
+	b := attach(t, m, &done)
+
+	for _, chunk := range []string{"one", "two"} {
+		if _, err := io.WriteString(stdin, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readN(t, a, 6); got != "onetwo" {
+		t.Fatalf("oldest connection got %q, want all of stdin", got)
+	}
+
+	// both connections' output goes to stdout
+	_, _ = io.WriteString(a, "from a\n")
+	_ = a.Close()
+	waitFor(t, "the first output", func() bool { return out.String() != "" })
+	_, _ = io.WriteString(b, "from b\n")
+	_ = b.Close()
+	done.Wait()
+	if got := out.String(); got != "from a\nfrom b\n" {
+		t.Fatalf("stdout = %q", got)
+	}
+}
+
+func TestStdioMux_FirstMovesOnWhenOldestLeaves(t *testing.T) {
+	m, stdin, _ := newTestMux(t, PolicyFirst, "")
+	var done sync.WaitGroup
+	a := attach(t, m, &done)
+	b := attach(t, m, &done)
+
+	_ = a.Close()
+	waitFor(t, "the closed connection to leave", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.conns) == 1
+	})
+	_, _ = io.WriteString(stdin, "hi")
+	if got := readN(t, b, 2); got != "hi" {
+		t.Fatalf("remaining connection got %q", got)
+	}
+}
+
+func TestStdioMux_RoundRobin(t *testing.T) {
+	m, stdin, _ := newTestMux(t, PolicyRR, "")
+	var done sync.WaitGroup
+	a := attach(t, m, &done)
+	b := attach(t, m, &done)
+
+	for _, chunk := range []string{"1", "2", "3", "4"} {
+		if _, err := io.WriteString(stdin, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readN(t, a, 2); got != "13" {
+		t.Errorf("first connection got %q, want 13", got)
+	}
+	if got := readN(t, b, 2); got != "24" {
+		t.Errorf("second connection got %q, want 24", got)
+	}
+}
+
+func TestStdioMux_Files(t *testing.T) {
+	dir := t.TempDir()
+	m, stdin, out := newTestMux(t, PolicyFiles, dir)
+	var done sync.WaitGroup
+	a := attach(t, m, &done)
+	b := attach(t, m, &done)
+
+	// stdin as for first
+	_, _ = io.WriteString(stdin, "in")
+	if got := readN(t, a, 2); got != "in" {
+		t.Fatalf("oldest connection got %q", got)
+	}
+
+	_, _ = io.WriteString(a, "from a")
+	_ = a.Close()
+	_, _ = io.WriteString(b, "from b")
+	_ = b.Close()
+	done.Wait()
+
+	if out.String() != "" {
+		t.Errorf("stdout = %q, want nothing", out.String())
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "conn-*.out"))
+	if err != nil || len(names) != 2 {
+		t.Fatalf("output files %v, %v; want two", names, err)
+	}
+	sort.Strings(names) // conn-1-… before conn-2-…
+	for i, want := range []string{"from a", "from b"} {
+		if b, _ := os.ReadFile(names[i]); string(b) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(names[i]), b, want)
+		}
+	}
+}
+
+func TestStdioMux_StdinEOF(t *testing.T) {
+	m, stdin, _ := newTestMux(t, PolicyFirst, "")
+	var done sync.WaitGroup
+	a := attach(t, m, &done)
+
+	_ = stdin.Close()
+	_ = a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := a.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read = %d, %v; want EOF once stdin is done", n, err)
+	}
+	// a connection that comes later is half-closed right away
+	b := attach(t, m, &done)
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := b.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read = %d, %v; want EOF for a late connection", n, err)
+	}
+}
+
+func TestNewStdioMux_UnknownPolicy(t *testing.T) {
+	if _, err := NewStdioMux("random", ""); err == nil {
+		t.Fatal("NewStdioMux accepted an unknown policy")
+	}
+}
@@ -0,0 +1,119 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// ErrAuthFailed means the proxy turned down the username and password.
+var ErrAuthFailed = errors.New("SOCKS proxy rejected the username or password")
+
+var replyText = map[byte]string{
+	GeneralFailure:      "general failure",
+	NotAllowed:          "connection not allowed by ruleset",
+	NetworkUnreachable:  "network unreachable",
+	HostUnreachable:     "host unreachable",
+	ConnectionRefused:   "connection refused",
+	TTLExpired:          "TTL expired",
+	CommandNotSupported: "command not supported",
+	AddrNotSupported:    "address type not supported",
+}
+
+// Connect asks the SOCKS5 proxy on conn to connect to target (host:port).
+// The host is passed on as given, so a name is resolved by the proxy. With
+// a non-empty user it authenticates with username and password (RFC 1929).
+func Connect(conn io.ReadWriter, user, password, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	greeting := []byte{version5, 1, methodNoAuth}
+	if user != "" {
+		greeting = []byte{version5, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return fmt.Errorf("SOCKS proxy greeting: %w", err)
+	}
+	if choice[0] != version5 {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", choice[0])
+	}
+	switch choice[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if user == "" {
+			return errors.New("SOCKS proxy requires a username and password")
+		}
+		if err := authenticate(conn, user, password); err != nil {
+			return err
+		}
+	default:
+		return errors.New("SOCKS proxy accepts none of our authentication methods")
+	}
+
+	req := []byte{version5, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %q", host)
+		}
+		req = append(req, atypDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, atypIPv4), ip4...)
+	} else {
+		req = append(append(req, atypIPv6), ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var rep [4]byte // version, reply, reserved, address type
+	if _, err := io.ReadFull(conn, rep[:]); err != nil {
+		return fmt.Errorf("SOCKS proxy reply: %w", err)
+	}
+	if rep[1] != Succeeded {
+		msg, ok := replyText[rep[1]]
+		if !ok {
+			msg = fmt.Sprintf("error %d", rep[1])
+		}
+		return fmt.Errorf("SOCKS proxy could not connect to %s: %s", target, msg)
+	}
+	// the bound address is of no interest, but must be read past
+	if _, err := readAddr(conn, rep[3]); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	return err
+}
+
+func authenticate(conn io.ReadWriter, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("SOCKS username or password too long")
+	}
+	msg := append([]byte{1, byte(len(user))}, user...)
+	msg = append(append(msg, byte(len(password))), password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
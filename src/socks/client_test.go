@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeProxy plays a SOCKS5 proxy that requires user "u", password "p" and
+// answers with code. It returns the CONNECT request it received.
+func fakeProxy(conn net.Conn, code byte) []byte {
+	defer conn.Close()
+	greeting := make([]byte, 4)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return nil
+	}
+	_, _ = conn.Write([]byte{5, methodUserPass})
+	auth := make([]byte, 5) // 1, 1, "u", 1, "p"
+	if _, err := io.ReadFull(conn, auth); err != nil {
+		return nil
+	}
+	if !bytes.Equal(auth, []byte{1, 1, 'u', 1, 'p'}) {
+		_, _ = conn.Write([]byte{1, 1})
+		return nil
+	}
+	_, _ = conn.Write([]byte{1, 0})
+	req := make([]byte, 5+len("db.internal")+2)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return nil
+	}
+	_, _ = conn.Write([]byte{5, code, 0, 1, 127, 0, 0, 1, 0x12, 0x34})
+	return req
+}
+
+func TestConnect_UserPass(t *testing.T) {
+	c1, c2 := net.Pipe()
+	got := make(chan []byte, 1)
+	go func() { got <- fakeProxy(c2, Succeeded) }()
+
+	if err := Connect(c1, "u", "p", "db.internal:5432"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	want := append([]byte{5, 1, 0, 3, 11}, "db.internal"...)
+	want = append(want, 0x15, 0x38)
+	if req := <-got; !bytes.Equal(req, want) {
+		t.Fatalf("request % x, want % x", req, want)
+	}
+}
+
+func TestConnect_Refused(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go fakeProxy(c2, ConnectionRefused)
+
+	err := Connect(c1, "u", "p", "db.internal:5432")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("got %v, want a connection refused error", err)
+	}
+}
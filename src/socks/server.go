@@ -0,0 +1,153 @@
+// Package socks speaks the parts of SOCKS5 (RFC 1928) xfer needs: CONNECT,
+// as a server without authentication and as a client with or without a
+// username and password.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const version5 = 5
+
+// Reply codes.
+const (
+	Succeeded           byte = 0
+	GeneralFailure      byte = 1
+	NotAllowed          byte = 2
+	NetworkUnreachable  byte = 3
+	HostUnreachable     byte = 4
+	ConnectionRefused   byte = 5
+	TTLExpired          byte = 6
+	CommandNotSupported byte = 7
+	AddrNotSupported    byte = 8
+)
+
+const (
+	methodNoAuth       byte = 0
+	methodUserPass     byte = 2
+	methodNoAcceptable byte = 0xFF
+
+	cmdConnect byte = 1
+
+	atypIPv4   byte = 1
+	atypDomain byte = 3
+	atypIPv6   byte = 4
+)
+
+// ReadRequest performs the server side of the SOCKS5 greeting, offering no
+// authentication, and reads the request. It returns the CONNECT target as
+// host:port. For other requests it sends the failure reply itself.
+func ReadRequest(conn io.ReadWriter) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != version5 {
+		return "", fmt.Errorf("not a SOCKS5 client (version %d)", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := methodNoAcceptable
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{version5, method}); err != nil {
+		return "", err
+	}
+	if method == methodNoAcceptable {
+		return "", errors.New("SOCKS client does not offer \"no authentication\"")
+	}
+
+	var req [4]byte // version, command, reserved, address type
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != version5 {
+		return "", fmt.Errorf("bad SOCKS request version %d", req[0])
+	}
+	host, err := readAddr(conn, req[3])
+	if err != nil {
+		_ = WriteReply(conn, AddrNotSupported, nil)
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != cmdConnect {
+		_ = WriteReply(conn, CommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, 4)
+		if atyp == atypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		return string(name), nil
+	}
+	return "", fmt.Errorf("unsupported SOCKS address type %d", atyp)
+}
+
+// WriteReply sends the reply to a request. bound is the address the proxy
+// connected from; nil sends 0.0.0.0:0.
+func WriteReply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := bound.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+	}
+	atyp := atypIPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		atyp = atypIPv6
+	}
+	msg := append([]byte{version5, code, 0, atyp}, ip...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	_, err := w.Write(msg)
+	return err
+}
+
+// ReplyCode picks the reply code that best describes a failed dial.
+func ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return Succeeded
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr), errors.As(err, &netErr) && netErr.Timeout():
+		return HostUnreachable
+	}
+	return GeneralFailure
+}
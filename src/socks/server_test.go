@@ -0,0 +1,66 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadRequest_Domain(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan []byte)
+	go func() {
+		// greeting offering user/pass and no-auth, then CONNECT example.com:443
+		_, _ = c1.Write([]byte{5, 2, 2, 0})
+		method := make([]byte, 2)
+		_, _ = io.ReadFull(c1, method)
+		req := append([]byte{5, 1, 0, 3, 11}, "example.com"...)
+		_, _ = c1.Write(append(req, 1, 187))
+		reply := make([]byte, 10)
+		_, _ = io.ReadFull(c1, reply)
+		done <- append(method, reply...)
+	}()
+
+	target, err := ReadRequest(c2)
+	if err != nil {
+		t.Fatalf("read request: %v", err)
+	}
+	if target != "example.com:443" {
+		t.Fatalf("target: got %q", target)
+	}
+	bound := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}
+	if err := WriteReply(c2, Succeeded, bound); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	want := []byte{5, 0, 5, 0, 0, 1, 10, 0, 0, 1, 0x04, 0x38}
+	if got := <-done; !bytes.Equal(got, want) {
+		t.Fatalf("client saw % x, want % x", got, want)
+	}
+}
+
+func TestReadRequest_UnsupportedCommand(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	code := make(chan byte)
+	go func() {
+		_, _ = c1.Write([]byte{5, 1, 0})
+		_, _ = io.ReadFull(c1, make([]byte, 2))
+		// BIND 1.2.3.4:80
+		_, _ = c1.Write([]byte{5, 2, 0, 1, 1, 2, 3, 4, 0, 80})
+		reply := make([]byte, 10)
+		_, _ = io.ReadFull(c1, reply)
+		code <- reply[1]
+	}()
+	if _, err := ReadRequest(c2); err == nil {
+		t.Fatal("BIND accepted")
+	}
+	if got := <-code; got != CommandNotSupported {
+		t.Fatalf("reply code %d, want %d", got, CommandNotSupported)
+	}
+}
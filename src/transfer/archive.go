@@ -0,0 +1,274 @@
+package transfer
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// writeArchive streams the tree under root as a tar archive. Entry names are
+// relative to root; regular files, directories and symlinks are included,
+// anything else (devices, sockets, fifos) is skipped with a warning.
+func writeArchive(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		switch {
+		case fi.Mode().IsRegular(), fi.IsDir():
+		case fi.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "skipping %s: unsupported file type\n", p)
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// owner names are meaningless on the receiving host
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extractArchive unpacks a tar stream into root, which must already exist.
+// Absolute names, ".." components, entries reached through a symlink and
+// symlinks pointing outside root are rejected. Symlinks are created once all
+// files and directories are written, so no entry can be written through
+// one, and modes and mtimes last so read-only directories can still be
+// filled.
+func extractArchive(r io.Reader, root string) (files int, err error) {
+	type dirAttr struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirAttr
+	var links []*tar.Header
+	// dropLink forgets a pending link that a later entry replaces
+	dropLink := func(rel string) {
+		for i, l := range links {
+			if l.Name == rel {
+				links = append(links[:i], links[i+1:]...)
+				return
+			}
+		}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, err
+		}
+
+		rel, err := safeRelPath(hdr.Name)
+		if err != nil {
+			return files, err
+		}
+		if err := checkParents(root, rel); err != nil {
+			return files, err
+		}
+		target := filepath.Join(root, filepath.FromSlash(rel))
+		dropLink(rel)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+				return files, err
+			}
+			dirs = append(dirs, dirAttr{target, hdr})
+
+		case tar.TypeReg:
+			if err := extractFile(tr, hdr, target); err != nil {
+				return files, err
+			}
+			files++
+
+		case tar.TypeSymlink:
+			hdr.Name = rel
+			links = append(links, hdr)
+
+		default:
+			return files, fmt.Errorf("%s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	for _, hdr := range links {
+		if err := extractSymlink(root, hdr.Name, hdr.Linkname); err != nil {
+			return files, err
+		}
+	}
+
+	// deepest first, so setting a parent's mtime is not undone by its children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		// Chmod and Chtimes follow links: skip what is no longer a directory
+		if fi, err := os.Lstat(d.path); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := os.Chmod(d.path, fs.FileMode(d.hdr.Mode).Perm()); err != nil {
+			return files, err
+		}
+		if err := os.Chtimes(d.path, d.hdr.ModTime, d.hdr.ModTime); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// extractSymlink creates the link rel -> link after checkSymlink, replacing
+// whatever is there except a directory.
+func extractSymlink(root, rel, link string) error {
+	if err := checkSymlink(root, rel, link); err != nil {
+		return err
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	if fi, err := os.Lstat(target); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("refusing symlink %s: a directory of that name exists", rel)
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(link, target)
+}
+
+func extractFile(r io.Reader, hdr *tar.Header, target string) error {
+	// never write through whatever is already there (e.g. an earlier symlink)
+	_ = os.Remove(target)
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, hdr.Size); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("%s: %w", hdr.Name, err)
+	}
+	if err := f.Chmod(fs.FileMode(hdr.Mode).Perm()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// safeRelPath validates an archive entry name and returns it cleaned.
+func safeRelPath(name string) (string, error) {
+	if name == "" || strings.Contains(name, "\\") || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("refusing unsafe path %q", name)
+	}
+	for _, part := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("refusing unsafe path %q", name)
+		}
+	}
+	rel := path.Clean(name)
+	if rel == "." {
+		return "", fmt.Errorf("refusing unsafe path %q", name)
+	}
+	return rel, nil
+}
+
+// checkParents makes sure no directory leading to rel is a symlink, so an
+// entry cannot be written through a link into somewhere else.
+func checkParents(root, rel string) error {
+	dir := root
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			return fmt.Errorf("%s: parent directory missing from archive", rel)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("refusing %s: parent %s is not a directory", rel, part)
+		}
+	}
+	return nil
+}
+
+// checkSymlink rejects links that are absolute or climb out of the tree.
+// The target is followed on disk, not just cleaned: every directory it
+// passes through must be a real directory under root, so links cannot be
+// chained (s -> ., d -> s/..) to get out.
+func checkSymlink(root, rel, link string) error {
+	if link == "" || path.IsAbs(link) || filepath.IsAbs(link) || filepath.VolumeName(link) != "" || strings.Contains(link, "\\") {
+		return fmt.Errorf("refusing symlink %s -> %s: target outside the tree", rel, link)
+	}
+	cur := path.Dir(rel) // checkParents made sure these are directories
+	parts := strings.Split(link, "/")
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if cur == "." {
+				return fmt.Errorf("refusing symlink %s -> %s: target outside the tree", rel, link)
+			}
+			cur = path.Dir(cur)
+			continue
+		}
+		cur = path.Join(cur, part)
+		if i == len(parts)-1 {
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(cur)))
+		if err != nil || !fi.IsDir() {
+			return fmt.Errorf("refusing symlink %s -> %s: %s is not a directory", rel, link, cur)
+		}
+	}
+	return nil
+}
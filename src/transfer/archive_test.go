@@ -0,0 +1,103 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendReceive_Directory(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	root := filepath.Join(srcDir, "tree")
+	mustMkdir(t, filepath.Join(root, "sub", "deeper"))
+	mustWrite(t, filepath.Join(root, "top.txt"), "top", 0o644)
+	mustWrite(t, filepath.Join(root, "sub", "run.sh"), "#!/bin/sh\n", 0o755)
+	mustWrite(t, filepath.Join(root, "sub", "deeper", "data"), strings.Repeat("d", 10000), 0o600)
+	if err := os.Symlink("sub/run.sh", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if sendErr, recvErr := runTransfer(t, root+"/", dstDir, false); sendErr != nil || recvErr != nil {
+		t.Fatalf("transfer failed: send=%v recv=%v", sendErr, recvErr)
+	}
+
+	got := filepath.Join(dstDir, "tree")
+	if b, _ := os.ReadFile(filepath.Join(got, "sub", "deeper", "data")); len(b) != 10000 {
+		t.Errorf("nested file has %d bytes, want 10000", len(b))
+	}
+	if fi, err := os.Stat(filepath.Join(got, "sub", "run.sh")); err != nil || fi.Mode().Perm() != 0o755 {
+		t.Errorf("run.sh mode = %v, %v; want 0755", fi.Mode().Perm(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(got, "link")); err != nil || link != "sub/run.sh" {
+		t.Errorf("symlink = %q, %v", link, err)
+	}
+}
+
+func TestExtractArchive_RejectsEscapes(t *testing.T) {
+	cases := map[string][]tar.Header{
+		"dotdot":         {{Name: "../evil", Typeflag: tar.TypeReg}},
+		"nested dotdot":  {{Name: "a/../../evil", Typeflag: tar.TypeReg}},
+		"absolute":       {{Name: "/tmp/evil", Typeflag: tar.TypeReg}},
+		"absolute link":  {{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		"escaping link":  {{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		"deep link":      {{Name: "d/", Typeflag: tar.TypeDir, Mode: 0o755}, {Name: "d/l", Typeflag: tar.TypeSymlink, Linkname: "../../x"}},
+		"through a link": {{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "."}, {Name: "l/f", Typeflag: tar.TypeReg}},
+		"hard link":      {{Name: "h", Typeflag: tar.TypeLink, Linkname: "f"}},
+		"chained links": {
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "d/", Typeflag: tar.TypeDir, Mode: 0o777},
+			{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "s/.."},
+		},
+		"chained links, reversed": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "s/.."},
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+	}
+	for name, entries := range cases {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, h := range entries {
+			if h.Mode == 0 {
+				h.Mode = 0o644
+			}
+			if err := tw.WriteHeader(&h); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		_ = tw.Close()
+
+		parent := t.TempDir()
+		root := filepath.Join(parent, "root")
+		mustMkdir(t, root)
+		before, _ := os.Stat(parent)
+		if _, err := extractArchive(&buf, root); err == nil {
+			t.Errorf("%s: archive accepted", name)
+		}
+		if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+			t.Errorf("%s: wrote outside the target: %v", name, entries)
+		}
+		if after, _ := os.Stat(parent); after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+			t.Errorf("%s: changed the directory above the target: %v -> %v", name, before.Mode(), after.Mode())
+		}
+	}
+}
+
+func mustMkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustWrite(t *testing.T, p, data string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(p, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		t.Fatal(err)
+	}
+}
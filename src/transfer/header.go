@@ -0,0 +1,138 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jnsoft/xfer/src/helpers"
+)
+
+var headerMagic = [4]byte{'X', 'F', 'E', 'R'}
+
+const headerVersion = 1
+
+// Kinds of payload announced by a Header.
+const (
+	KindFile = 'f' // Size bytes of file data follow
+	KindDir  = 'd' // a tar stream of the directory tree follows
+)
+
+// Header describes the file or directory that follows it on the wire.
+type Header struct {
+	Kind    byte
+	Name    string      // base name only, never a path
+	Size    int64       // number of data bytes that follow (files only)
+	Mode    os.FileMode // permission bits
+	ModTime time.Time
+}
+
+const headerLen = 4 + 1 + 1 + 8 + 4 + 8
+
+// WriteHeader encodes h as: magic, version, kind, size u64, mode u32, mtime
+// (unix nanoseconds) i64, then the length-prefixed name.
+func WriteHeader(w io.Writer, h Header) error {
+	var buf [headerLen]byte
+	copy(buf[0:4], headerMagic[:])
+	buf[4] = headerVersion
+	buf[5] = h.Kind
+	binary.BigEndian.PutUint64(buf[6:14], uint64(h.Size))
+	binary.BigEndian.PutUint32(buf[14:18], uint32(h.Mode.Perm()))
+	binary.BigEndian.PutUint64(buf[18:26], uint64(h.ModTime.UnixNano()))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	return helpers.WriteBytesWithLen(w, []byte(h.Name))
+}
+
+// ReadHeader decodes a header written by WriteHeader.
+func ReadHeader(r io.Reader) (Header, error) {
+	var buf [headerLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return Header{}, err
+	}
+	if [4]byte(buf[0:4]) != headerMagic {
+		return Header{}, errors.New("peer is not sending an xfer file header")
+	}
+	if buf[4] != headerVersion {
+		return Header{}, fmt.Errorf("unsupported header version %d", buf[4])
+	}
+	if buf[5] != KindFile && buf[5] != KindDir {
+		return Header{}, fmt.Errorf("unknown payload kind %q", buf[5])
+	}
+	name, err := helpers.ReadBytesWithLen(r)
+	if err != nil {
+		return Header{}, err
+	}
+	size := int64(binary.BigEndian.Uint64(buf[6:14]))
+	if size < 0 {
+		return Header{}, errors.New("invalid file size")
+	}
+	return Header{
+		Kind:    buf[5],
+		Name:    string(name),
+		Size:    size,
+		Mode:    os.FileMode(binary.BigEndian.Uint32(buf[14:18])).Perm(),
+		ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(buf[18:26]))),
+	}, nil
+}
+
+// writeStatus sends an empty message for success or the error text.
+func writeStatus(w io.Writer, err error) error {
+	if err == nil {
+		return helpers.WriteBytesWithLen(w, nil)
+	}
+	return helpers.WriteBytesWithLen(w, []byte(err.Error()))
+}
+
+// readStatus returns the peer's error, if it reported one.
+func readStatus(r io.Reader) error {
+	msg, err := helpers.ReadBytesWithLen(r)
+	if err != nil {
+		return fmt.Errorf("reading peer status: %w", err)
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf("peer: %s", msg)
+	}
+	return nil
+}
+
+// writeResume tells the sender how much of the file we already have and the
+// SHA-256 of that prefix.
+func writeResume(w io.Writer, offset int64, sum [sha256.Size]byte) error {
+	var buf [8 + sha256.Size]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(offset))
+	copy(buf[8:], sum[:])
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readResume(r io.Reader) (int64, [sha256.Size]byte, error) {
+	var buf [8 + sha256.Size]byte
+	var sum [sha256.Size]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, sum, err
+	}
+	copy(sum[:], buf[8:])
+	return int64(binary.BigEndian.Uint64(buf[:8])), sum, nil
+}
+
+// writeOffset sends the offset the sender will actually start from.
+func writeOffset(w io.Writer, offset int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(offset))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readOffset(r io.Reader) (int64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(buf[:])), nil
+}
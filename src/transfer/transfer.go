@@ -0,0 +1,320 @@
+// Package transfer implements the send and recv subcommands: a small header
+// describing the file or directory, then its data, over any established
+// connection.
+//
+// The exchange is
+//
+//	sender -> receiver: header
+//	receiver -> sender: status (empty = go ahead, otherwise why not)
+//	receiver -> sender: bytes already held + SHA-256 of them (files only)
+//	sender -> receiver: offset it will resume from (files only)
+//	sender -> receiver: the rest of the file data, or a tar stream for a directory
+//	receiver -> sender: status (empty = everything written)
+//
+// An interrupted file transfer leaves a ".<name>.xfer-part" file next to the
+// target; sending the same file again continues where it stopped as long as
+// the partial data still matches the start of the source.
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Send transfers the file or directory tree at path over conn and waits for
+// the receiver to confirm it was written. Directories are streamed as a tar
+// archive generated on the fly.
+func Send(conn net.Conn, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return sendDir(conn, path, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := Header{
+		Kind:    KindFile,
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+	if err := WriteHeader(conn, h); err != nil {
+		return err
+	}
+	if err := readStatus(conn); err != nil {
+		return err
+	}
+
+	start, err := resumeOffset(conn, f, h.Size)
+	if err != nil {
+		return err
+	}
+	if err := writeOffset(conn, start); err != nil {
+		return err
+	}
+	if start > 0 {
+		fmt.Fprintf(os.Stderr, "resuming %s at byte %d\n", h.Name, start)
+	}
+	expectTotal(conn, h.Size-start)
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(conn, f, h.Size-start); err != nil {
+		return fmt.Errorf("sending %s: %w", h.Name, err)
+	}
+	if err := readStatus(conn); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "sent %s (%d bytes)\n", h.Name, h.Size)
+	return nil
+}
+
+// expectTotal tells a progress display on conn, if any, how much data to
+// expect so it can estimate the time left.
+func expectTotal(conn net.Conn, n int64) {
+	if s, ok := conn.(interface{ ExpectTotal(int64) }); ok {
+		s.ExpectTotal(n)
+	}
+}
+
+// resumeOffset reads what the receiver already has and returns where to
+// continue: its offset if the prefix hash matches our file, otherwise 0.
+func resumeOffset(conn net.Conn, f *os.File, size int64) (int64, error) {
+	offset, sum, err := readResume(conn)
+	if err != nil {
+		return 0, err
+	}
+	if offset <= 0 || offset > size {
+		return 0, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, offset)); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(h.Sum(nil), sum[:]) {
+		fmt.Fprintf(os.Stderr, "partial data on receiver does not match, starting over\n")
+		return 0, nil
+	}
+	return offset, nil
+}
+
+func sendDir(conn net.Conn, root string, fi os.FileInfo) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	h := Header{
+		Kind:    KindDir,
+		Name:    filepath.Base(abs),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+	if err := WriteHeader(conn, h); err != nil {
+		return err
+	}
+	if err := readStatus(conn); err != nil {
+		return err
+	}
+	if err := writeArchive(conn, root); err != nil {
+		return fmt.Errorf("sending %s: %w", root, err)
+	}
+	if err := readStatus(conn); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "sent %s/\n", h.Name)
+	return nil
+}
+
+// Receive reads one file or directory tree from conn into dir. The data goes
+// to a temporary file or directory that is renamed into place only once it is
+// complete, and an existing one is replaced only when force is set.
+func Receive(conn net.Conn, dir string, force bool) error {
+	h, err := ReadHeader(conn)
+	if err != nil {
+		return err
+	}
+
+	target, err := prepareTarget(dir, h.Name, force)
+	if err != nil {
+		_ = writeStatus(conn, err)
+		return err
+	}
+	if err := writeStatus(conn, nil); err != nil {
+		return err
+	}
+
+	if h.Kind == KindDir {
+		files, err := receiveDir(conn, h, target, force)
+		_ = writeStatus(conn, err)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "received %s/ (%d files)\n", target, files)
+		return nil
+	}
+
+	part := partPath(target)
+	have, sum, err := partialState(part, h.Size)
+	if err != nil {
+		return err
+	}
+	if err := writeResume(conn, have, sum); err != nil {
+		return err
+	}
+	start, err := readOffset(conn)
+	if err != nil {
+		return err
+	}
+	if start < 0 || start > have {
+		return fmt.Errorf("peer wants to resume at %d but only %d bytes are here", start, have)
+	}
+	if start > 0 {
+		fmt.Fprintf(os.Stderr, "resuming %s at byte %d\n", target, start)
+	}
+	expectTotal(conn, h.Size-start)
+
+	err = receiveFile(conn, h, part, start, target)
+	_ = writeStatus(conn, err)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "received %s (%d bytes)\n", target, h.Size)
+	return nil
+}
+
+// prepareTarget validates the name sent by the peer and returns the path the
+// file will be written to.
+func prepareTarget(dir, name string, force bool) (string, error) {
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("refusing unsafe file name %q", name)
+	}
+	target := filepath.Join(dir, name)
+	if _, err := os.Lstat(target); err == nil {
+		if !force {
+			return "", fmt.Errorf("%s already exists (use -f to overwrite)", target)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return target, nil
+}
+
+// partPath is where an incomplete download of target is kept.
+func partPath(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".xfer-part")
+}
+
+// partialState reports how many bytes of a previous attempt are on disk and
+// their SHA-256. A partial file longer than the new one is not reused.
+func partialState(part string, size int64) (int64, [sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(part)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, sum, nil
+	}
+	if err != nil {
+		return 0, sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, sum, err
+	}
+	if n == 0 || n > size {
+		return 0, sum, nil
+	}
+	copy(sum[:], h.Sum(nil))
+	return n, sum, nil
+}
+
+// receiveFile writes the data from offset start on into part, which is kept
+// if the transfer breaks off and renamed to target once complete.
+func receiveFile(r io.Reader, h Header, part string, start int64, target string) error {
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(start); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if _, err := io.CopyN(f, r, h.Size-start); err != nil {
+		// keep what we got for the next attempt
+		_ = f.Sync()
+		_ = f.Close()
+		return fmt.Errorf("receiving %s: %w", h.Name, err)
+	}
+	if err := f.Chmod(h.Mode); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(part, h.ModTime, h.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(part, target)
+}
+
+func receiveDir(r io.Reader, h Header, target string, force bool) (int, error) {
+	tmp, err := os.MkdirTemp(filepath.Dir(target), "."+h.Name+".*.part")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp) // no-op once renamed
+
+	files, err := extractArchive(r, tmp)
+	if err != nil {
+		return files, fmt.Errorf("receiving %s: %w", h.Name, err)
+	}
+	if err := os.Chmod(tmp, h.Mode); err != nil {
+		return files, err
+	}
+	if err := os.Chtimes(tmp, h.ModTime, h.ModTime); err != nil {
+		return files, err
+	}
+
+	// a directory cannot be renamed over an existing one, so move the old
+	// tree aside first and only delete it once the new one is in place
+	if _, err := os.Lstat(target); err == nil && force {
+		old := tmp + ".old"
+		if err := os.Rename(target, old); err != nil {
+			return files, err
+		}
+		if err := os.Rename(tmp, target); err != nil {
+			_ = os.Rename(old, target)
+			return files, err
+		}
+		return files, os.RemoveAll(old)
+	}
+	return files, os.Rename(tmp, target)
+}
@@ -0,0 +1,171 @@
+package transfer
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runTransfer(t *testing.T, src, dir string, force bool) (sendErr, recvErr error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Receive(c2, dir, force)
+		_ = c2.Close()
+	}()
+	sendErr = Send(c1, src)
+	_ = c1.Close()
+	return sendErr, <-done
+}
+
+func TestSendReceive_RoundTrip(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src := filepath.Join(srcDir, "data.bin")
+	data := bytes.Repeat([]byte("xfer"), 50000)
+	if err := os.WriteFile(src, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if sendErr, recvErr := runTransfer(t, src, dstDir, false); sendErr != nil || recvErr != nil {
+		t.Fatalf("transfer failed: send=%v recv=%v", sendErr, recvErr)
+	}
+
+	dst := filepath.Join(dstDir, "data.bin")
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("content mismatch")
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want 0640", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+	entries, _ := os.ReadDir(dstDir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestSendReceive_RefusesOverwrite(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src := filepath.Join(srcDir, "a.txt")
+	if err := os.WriteFile(src, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dstDir, "a.txt")
+	if err := os.WriteFile(dst, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sendErr, recvErr := runTransfer(t, src, dstDir, false)
+	if sendErr == nil || recvErr == nil {
+		t.Fatalf("expected both sides to fail: send=%v recv=%v", sendErr, recvErr)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "old" {
+		t.Fatalf("existing file was modified: %q", got)
+	}
+
+	if sendErr, recvErr := runTransfer(t, src, dstDir, true); sendErr != nil || recvErr != nil {
+		t.Fatalf("forced transfer failed: send=%v recv=%v", sendErr, recvErr)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "new" {
+		t.Fatalf("file not overwritten: %q", got)
+	}
+}
+
+func TestReceive_RejectsUnsafeName(t *testing.T) {
+	for _, name := range []string{"../evil", "/etc/passwd", "..", "a/b"} {
+		c1, c2 := net.Pipe()
+		go func() {
+			_ = WriteHeader(c1, Header{Kind: KindFile, Name: name, Size: 1, Mode: 0o644})
+			_ = readStatus(c1)
+			_ = c1.Close()
+		}()
+		err := Receive(c2, t.TempDir(), true)
+		_ = c2.Close()
+		if err == nil || !strings.Contains(err.Error(), "unsafe") {
+			t.Errorf("name %q: got %v, want unsafe name error", name, err)
+		}
+	}
+}
+
+// countingConn counts the bytes written through it.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestSendReceive_Resume(t *testing.T) {
+	srcDir := t.TempDir()
+	src := filepath.Join(srcDir, "big.bin")
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		partial []byte
+		maxSent int64
+	}{
+		{"matching prefix", data[:600000], 400000 + 1024},
+		{"stale prefix", bytes.Repeat([]byte("x"), 600000), 1000000 + 1024},
+	} {
+		dstDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dstDir, ".big.bin.xfer-part"), tc.partial, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		c1, c2 := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- Receive(c2, dstDir, false) }()
+		cc := &countingConn{Conn: c1}
+		sendErr := Send(cc, src)
+		recvErr := <-done
+		_ = c1.Close()
+		_ = c2.Close()
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("%s: transfer failed: send=%v recv=%v", tc.name, sendErr, recvErr)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dstDir, "big.bin"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: content mismatch (%v)", tc.name, err)
+		}
+		if cc.n > tc.maxSent {
+			t.Errorf("%s: sent %d bytes, want at most %d", tc.name, cc.n, tc.maxSent)
+		}
+		if cc.n < tc.maxSent-2048 {
+			t.Errorf("%s: sent only %d bytes, resumed where it should not", tc.name, cc.n)
+		}
+		if _, err := os.Stat(filepath.Join(dstDir, ".big.bin.xfer-part")); !os.IsNotExist(err) {
+			t.Errorf("%s: partial file left behind", tc.name)
+		}
+	}
+}